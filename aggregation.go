@@ -0,0 +1,134 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"fmt"
+	prometheusClient "github.com/prometheus/client_model/go"
+	log "github.hpe.com/kronos/kelog"
+	"math"
+)
+
+var aggregationOperators = map[string]func(values []float64) float64{
+	"sum":   sumValues,
+	"avg":   avgValues,
+	"min":   minValues,
+	"max":   maxValues,
+	"count": countValues,
+}
+
+type aggregationGroup struct {
+	labels []*prometheusClient.LabelPair
+	values []float64
+}
+
+func validateAggregation(rule SidecarRule) error {
+	if rule.Aggregate == "" {
+		if len(rule.By) > 0 || len(rule.Without) > 0 {
+			return fmt.Errorf("rule %v sets by or without without aggregate", rule.Name)
+		}
+		return nil
+	}
+	if _, ok := aggregationOperators[rule.Aggregate]; !ok {
+		return fmt.Errorf("rule %v with invalid aggregate %v", rule.Name, rule.Aggregate)
+	}
+	if len(rule.By) > 0 && len(rule.Without) > 0 {
+		return fmt.Errorf("rule %v can not set both by and without", rule.Name)
+	}
+	return nil
+}
+
+// aggregateMetricFamilies collapses the series calculated for a rule into one series per group of
+// labels kept by the by or without clause of the rule.
+func aggregateMetricFamilies(metricFamilies []*prometheusClient.MetricFamily, rule SidecarRule) []*prometheusClient.MetricFamily {
+	aggregationOperator, ok := aggregationOperators[rule.Aggregate]
+	if !ok {
+		return metricFamilies
+	}
+	groupKeys := []string{}
+	groups := map[string]*aggregationGroup{}
+	for _, mf := range metricFamilies {
+		for _, metric := range mf.Metric {
+			value, succeed := getValueBasedOnType(*mf.Type, *metric)
+			if !succeed {
+				continue
+			}
+			groupLabels := getAggregationLabels(metric.Label, rule)
+			groupKey := convertLabelsIntoKey(groupLabels)
+			group, ok := groups[groupKey]
+			if !ok {
+				group = &aggregationGroup{labels: groupLabels}
+				groups[groupKey] = group
+				groupKeys = append(groupKeys, groupKey)
+			}
+			group.values = append(group.values, value)
+		}
+	}
+
+	aggregatedMetricFamilies := []*prometheusClient.MetricFamily{}
+	for _, groupKey := range groupKeys {
+		group := groups[groupKey]
+		aggregatedMetricFamilies = append(aggregatedMetricFamilies, createNewMetricFamilies(rule.Name, group.labels, aggregationOperator(group.values)))
+	}
+	log.Debugf("Successfully aggregated %v by %v without %v for rule %v", rule.Aggregate, rule.By, rule.Without, rule.Name)
+	return aggregatedMetricFamilies
+}
+
+func getAggregationLabels(labels []*prometheusClient.LabelPair, rule SidecarRule) []*prometheusClient.LabelPair {
+	groupLabels := []*prometheusClient.LabelPair{}
+	if len(rule.By) == 0 && len(rule.Without) == 0 {
+		// aggregate every series into one
+		return groupLabels
+	}
+	for _, label := range labels {
+		if len(rule.By) > 0 && !containsString(rule.By, *label.Name) {
+			continue
+		}
+		if containsString(rule.Without, *label.Name) {
+			continue
+		}
+		groupLabels = append(groupLabels, label)
+	}
+	return groupLabels
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func sumValues(values []float64) float64 {
+	sum := 0.0
+	for _, value := range values {
+		sum += value
+	}
+	return sum
+}
+
+func avgValues(values []float64) float64 {
+	return sumValues(values) / float64(len(values))
+}
+
+func minValues(values []float64) float64 {
+	min := math.Inf(+1)
+	for _, value := range values {
+		min = math.Min(min, value)
+	}
+	return min
+}
+
+func maxValues(values []float64) float64 {
+	max := math.Inf(-1)
+	for _, value := range values {
+		max = math.Max(max, value)
+	}
+	return max
+}
+
+func countValues(values []float64) float64 {
+	return float64(len(values))
+}
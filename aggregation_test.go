@@ -0,0 +1,114 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestAggregateMetricFamilies(t *testing.T) {
+	prometheusMetricsString := `
+# HELP request_count Counts requests by service and path
+# TYPE request_count counter
+request_count{instance="a",path="/rest/metrics",service="metrics"} 10
+request_count{instance="b",path="/rest/metrics",service="metrics"} 20
+request_count{instance="a",path="/rest/metrics/1",service="metrics"} 30
+request_count{instance="a",path="/rest/support",service="support"} 5
+`
+	metricFamilies, err := parsePrometheusMetricsToMetricFamilies(prometheusMetricsString)
+	assert.NoError(t, err)
+
+	sumByRule := SidecarRule{Name: "aggregateRuleTestName", Aggregate: "sum", By: []string{"service"}}
+	sumByMetricString := convertMetricFamiliesIntoTextString(aggregateMetricFamilies(metricFamilies, sumByRule))
+	expectedSumByMetricString := `# HELP aggregateRuleTestName aggregateRuleTestName
+# TYPE aggregateRuleTestName gauge
+aggregateRuleTestName{service="metrics"} 60
+# HELP aggregateRuleTestName aggregateRuleTestName
+# TYPE aggregateRuleTestName gauge
+aggregateRuleTestName{service="support"} 5
+`
+	assert.Equal(t, expectedSumByMetricString, sumByMetricString)
+
+	maxWithoutRule := SidecarRule{Name: "aggregateRuleTestName", Aggregate: "max", Without: []string{"instance"}}
+	maxWithoutMetricString := convertMetricFamiliesIntoTextString(aggregateMetricFamilies(metricFamilies, maxWithoutRule))
+	expectedMaxWithoutMetricString := `# HELP aggregateRuleTestName aggregateRuleTestName
+# TYPE aggregateRuleTestName gauge
+aggregateRuleTestName{path="/rest/metrics",service="metrics"} 20
+# HELP aggregateRuleTestName aggregateRuleTestName
+# TYPE aggregateRuleTestName gauge
+aggregateRuleTestName{path="/rest/metrics/1",service="metrics"} 30
+# HELP aggregateRuleTestName aggregateRuleTestName
+# TYPE aggregateRuleTestName gauge
+aggregateRuleTestName{path="/rest/support",service="support"} 5
+`
+	assert.Equal(t, expectedMaxWithoutMetricString, maxWithoutMetricString)
+
+	// no by or without collapses every series
+	countRule := SidecarRule{Name: "aggregateRuleTestName", Aggregate: "count"}
+	countMetricString := convertMetricFamiliesIntoTextString(aggregateMetricFamilies(metricFamilies, countRule))
+	expectedCountMetricString := `# HELP aggregateRuleTestName aggregateRuleTestName
+# TYPE aggregateRuleTestName gauge
+aggregateRuleTestName 4
+`
+	assert.Equal(t, expectedCountMetricString, countMetricString)
+
+	avgRule := SidecarRule{Name: "aggregateRuleTestName", Aggregate: "avg", By: []string{"instance"}}
+	avgMetricString := convertMetricFamiliesIntoTextString(aggregateMetricFamilies(metricFamilies, avgRule))
+	expectedAvgMetricString := `# HELP aggregateRuleTestName aggregateRuleTestName
+# TYPE aggregateRuleTestName gauge
+aggregateRuleTestName{instance="a"} 15
+# HELP aggregateRuleTestName aggregateRuleTestName
+# TYPE aggregateRuleTestName gauge
+aggregateRuleTestName{instance="b"} 20
+`
+	assert.Equal(t, expectedAvgMetricString, avgMetricString)
+
+	// without aggregate the metric families are not changed
+	assert.Equal(t, metricFamilies, aggregateMetricFamilies(metricFamilies, SidecarRule{Name: "aggregateRuleTestName"}))
+}
+
+func TestValidateAggregation(t *testing.T) {
+	assert.NoError(t, validateAggregation(SidecarRule{Name: "request_count_rate"}))
+	assert.NoError(t, validateAggregation(SidecarRule{Name: "request_count_rate", Aggregate: "sum", By: []string{"service"}}))
+	assert.NoError(t, validateAggregation(SidecarRule{Name: "request_count_rate", Aggregate: "min", Without: []string{"pod"}}))
+	assert.Error(t, validateAggregation(SidecarRule{Name: "request_count_rate", Aggregate: "median"}))
+	assert.Error(t, validateAggregation(SidecarRule{Name: "request_count_rate", By: []string{"service"}}))
+	assert.Error(t, validateAggregation(SidecarRule{Name: "request_count_rate", Aggregate: "sum", By: []string{"service"}, Without: []string{"pod"}}))
+}
+
+func TestCalculateSidecarRulesWithAggregation(t *testing.T) {
+	sidecarRules, errUnmarshal := unmarshalSidecarRules(`
+- metricName: request_count_rate
+  function: rate
+  parameters:
+    name: request_count
+  aggregate: sum
+  by:
+  - service`)
+	assert.NoError(t, errUnmarshal)
+	snapshots := newSnapshotBuffer(1)
+	oldMetricFamilies, errOldMF := parsePrometheusMetricsToMetricFamilies(`
+# TYPE request_count counter
+request_count{path="/rest/metrics",service="metrics"} 10
+request_count{path="/rest/metrics/1",service="metrics"} 20
+`)
+	newMetricFamilies, errNewMF := parsePrometheusMetricsToMetricFamilies(`
+# TYPE request_count counter
+request_count{path="/rest/metrics",service="metrics"} 30
+request_count{path="/rest/metrics/1",service="metrics"} 60
+`)
+	assert.NoError(t, errOldMF)
+	assert.NoError(t, errNewMF)
+	snapshots.add(newPrometheusSnapshot(oldMetricFamilies, time.Time{}))
+	newSnapshot := newPrometheusSnapshot(newMetricFamilies, snapshots.get(0).timestamp.Add(10*time.Second))
+
+	// (30 - 10) / 10 + (60 - 20) / 10 = 6
+	newSidecarMetrics := calculateSidecarRules(sidecarRules, newSnapshot, snapshots)
+	expectedSidecarMetricString := `# HELP request_count_rate request_count_rate
+# TYPE request_count_rate gauge
+request_count_rate{service="metrics"} 6
+`
+	assert.Equal(t, expectedSidecarMetricString, convertMetricFamiliesIntoTextString(newSidecarMetrics))
+}
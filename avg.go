@@ -7,15 +7,34 @@ import (
 	log "github.hpe.com/kronos/kelog"
 )
 
-func calculateAvg(newPrometheusMetrics []*prometheusClient.MetricFamily, oldPrometheusMetrics []*prometheusClient.MetricFamily, rule SidecarRule) []*prometheusClient.MetricFamily {
+func init() {
+	registerRuleFunction("avg", avgFunction{})
+}
+
+type avgFunction struct{}
+
+func (avgFunction) ValidateParameters(rule SidecarRule) error {
+	if err := checkRequiredParameters(rule, "name"); err != nil {
+		return err
+	}
+	return checkDurationParameters(rule, "window")
+}
+
+func (avgFunction) Calculate(newSnapshot prometheusSnapshot, oldSnapshot prometheusSnapshot, rule SidecarRule) []*prometheusClient.MetricFamily {
+	return calculateAvg(newSnapshot, oldSnapshot, rule)
+}
+
+func (avgFunction) CalculateWindow(snapshots []prometheusSnapshot, rule SidecarRule) []*prometheusClient.MetricFamily {
+	// average every scrape within the window like avgOverTime
+	return calculateOverTime(snapshots, rule, avgOverTime)
+}
+
+func calculateAvg(newSnapshot prometheusSnapshot, oldSnapshot prometheusSnapshot, rule SidecarRule) []*prometheusClient.MetricFamily {
 	newAvgMetrics := []*prometheusClient.MetricFamily{}
 	// find old value and new value
-	for _, pm := range newPrometheusMetrics {
-		if *pm.Name != rule.Parameters["name"] {
-			continue
-		}
+	for _, pm := range selectMetricFamilies(newSnapshot.metrics, rule.Parameters["name"]) {
 		for _, newM := range pm.Metric {
-			oldValueFloat, succeedOld := findOldValueWithMetricFamily(oldPrometheusMetrics, newM, *pm.Name, *pm.Type)
+			oldValueFloat, succeedOld := oldSnapshot.index.findValue(*pm.Name, *pm.Type, newM.Label)
 			if succeedOld {
 				// calculate avg
 				newValueFloat, succeedNew := getValueBasedOnType(*pm.Type, *newM)
@@ -40,7 +40,7 @@ request_total_time{method="POST",path="/rest/support"} 1.0
 
 	// (30 + 25) / 2 = 27.5
 	// (20 + 10) / 2 = 15
-	avgMetricFamilies := calculateAvg(newMetricFamilies, oldMetricFamilies, avgRule)
+	avgMetricFamilies := calculateAvg(newTestSnapshot(newMetricFamilies, 30), newTestSnapshot(oldMetricFamilies, 0), avgRule)
 	avgMetricString := convertMetricFamiliesIntoTextString(avgMetricFamilies)
 	expectedAvgMetricString := `# HELP avgRuleTestName avgRuleTestName
 # TYPE avgRuleTestName gauge
@@ -75,7 +75,7 @@ request_count{method="POST",path="/rest/support/2"} 20
 	avgRuleParam["name"] = "request_count"
 	avgRule := SidecarRule{Name: "avgRuleTestName", Function: "avg", Parameters: avgRuleParam}
 
-	avgMetricFamilies := calculateAvg(newMetricFamilies, oldMetricFamilies, avgRule)
+	avgMetricFamilies := calculateAvg(newTestSnapshot(newMetricFamilies, 30), newTestSnapshot(oldMetricFamilies, 0), avgRule)
 	assert.Equal(t, 0, len(avgMetricFamilies))
 }
 
@@ -117,7 +117,7 @@ http_request_duration_seconds_count 149320
 	avgRuleParam["name"] = "http_request_duration_seconds_bucket"
 	avgRuleBucket := SidecarRule{Name: "avgRuleTestHistogramName", Function: "avg", Parameters: avgRuleParam}
 
-	avgMetricFamiliesBucket := calculateAvg(newPrometheusMetricsWithNoHistogramSummary, oldPrometheusMetricsWithNoHistogramSummary, avgRuleBucket)
+	avgMetricFamiliesBucket := calculateAvg(newTestSnapshot(newPrometheusMetricsWithNoHistogramSummary, 30), newTestSnapshot(oldPrometheusMetricsWithNoHistogramSummary, 0), avgRuleBucket)
 	avgMetricStringBucket := convertMetricFamiliesIntoTextString(avgMetricFamiliesBucket)
 
 	expectedResultBucket := `# HELP avgRuleTestHistogramName avgRuleTestHistogramName
@@ -145,7 +145,7 @@ avgRuleTestHistogramName{le="1"} 134988
 	avgRuleParam["name"] = "http_request_duration_seconds_sum"
 	avgRuleSum := SidecarRule{Name: "avgRuleTestHistogramName", Function: "avg", Parameters: avgRuleParam}
 
-	avgMetricFamiliesSum := calculateAvg(newPrometheusMetricsWithNoHistogramSummary, oldPrometheusMetricsWithNoHistogramSummary, avgRuleSum)
+	avgMetricFamiliesSum := calculateAvg(newTestSnapshot(newPrometheusMetricsWithNoHistogramSummary, 30), newTestSnapshot(oldPrometheusMetricsWithNoHistogramSummary, 0), avgRuleSum)
 	avgMetricStringSum := convertMetricFamiliesIntoTextString(avgMetricFamiliesSum)
 
 	expectedResultSum := `# HELP avgRuleTestHistogramName avgRuleTestHistogramName
@@ -158,7 +158,7 @@ avgRuleTestHistogramName 58423
 	avgRuleParam["name"] = "http_request_duration_seconds_count"
 	avgRuleCount := SidecarRule{Name: "avgRuleTestHistogramName", Function: "avg", Parameters: avgRuleParam}
 
-	avgMetricFamiliesCount := calculateAvg(newPrometheusMetricsWithNoHistogramSummary, oldPrometheusMetricsWithNoHistogramSummary, avgRuleCount)
+	avgMetricFamiliesCount := calculateAvg(newTestSnapshot(newPrometheusMetricsWithNoHistogramSummary, 30), newTestSnapshot(oldPrometheusMetricsWithNoHistogramSummary, 0), avgRuleCount)
 	avgMetricStringCount := convertMetricFamiliesIntoTextString(avgMetricFamiliesCount)
 
 	expectedResultCount := `# HELP avgRuleTestHistogramName avgRuleTestHistogramName
@@ -167,3 +167,23 @@ avgRuleTestHistogramName 146820
 `
 	assert.Equal(t, expectedResultCount, avgMetricStringCount)
 }
+
+func TestCalculateAvgWithWindow(t *testing.T) {
+	snapshots := []prometheusSnapshot{}
+	for i, value := range []string{"10", "40", "100"} {
+		metricFamilies, err := parsePrometheusMetricsToMetricFamilies(`
+# TYPE queue_length gauge
+queue_length{queue="jobs"} ` + value + "\n")
+		assert.NoError(t, err)
+		snapshots = append(snapshots, newTestSnapshot(metricFamilies, float64(30*i)))
+	}
+	avgRule := SidecarRule{Name: "avgRuleTestName", Function: "avg", Parameters: map[string]string{"name": "queue_length", "window": "1m"}}
+
+	// ((10 + 40) / 2 * 30 + (40 + 100) / 2 * 30) / 60 = 47.5
+	avgMetricFamilies := avgFunction{}.CalculateWindow(snapshots, avgRule)
+	expectedAvgMetricString := `# HELP avgRuleTestName avgRuleTestName
+# TYPE avgRuleTestName gauge
+avgRuleTestName{queue="jobs"} 47.5
+`
+	assert.Equal(t, expectedAvgMetricString, convertMetricFamiliesIntoTextString(avgMetricFamilies))
+}
@@ -0,0 +1,83 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	prometheusClient "github.com/prometheus/client_model/go"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// runCheck validates the rules of a file and, given two saved scrapes, prints the metrics the rules calculate:
+//
+//	monasca-sidecar check --rules rules.yaml --before a.prom --after b.prom --interval 30
+func runCheck(arguments []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	rulesFile := flags.String("rules", "", "YAML file with a list of sidecar rules")
+	beforeFile := flags.String("before", "", "prometheus exposition of the old scrape")
+	afterFile := flags.String("after", "", "prometheus exposition of the new scrape")
+	queryInterval := flags.Float64("interval", 30.0, "seconds between the old and the new scrape")
+	if err := flags.Parse(arguments); err != nil {
+		return err
+	}
+	if *rulesFile == "" {
+		return fmt.Errorf("--rules is required")
+	}
+	if (*beforeFile == "") != (*afterFile == "") {
+		return fmt.Errorf("--before and --after are required together")
+	}
+	if *queryInterval <= 0 {
+		return fmt.Errorf("--interval must be positive")
+	}
+
+	rules, err := ioutil.ReadFile(*rulesFile)
+	if err != nil {
+		return fmt.Errorf("error reading rules file: %v", err)
+	}
+	sidecarRules, err := unmarshalSidecarRules(string(rules))
+	if err != nil {
+		return fmt.Errorf("error parsing sidecar rules: %v", err)
+	}
+	if err := validateSidecarRules(sidecarRules); err != nil {
+		return err
+	}
+	sidecarRules, err = sortSidecarRulesByDependency(sidecarRules)
+	if err != nil {
+		return err
+	}
+	if *beforeFile == "" {
+		fmt.Fprintf(stdout, "%v sidecar rules are valid\n", len(sidecarRules))
+		return nil
+	}
+
+	oldPrometheusMetrics, err := readPrometheusMetricsFile(*beforeFile)
+	if err != nil {
+		return err
+	}
+	newPrometheusMetrics, err := readPrometheusMetricsFile(*afterFile)
+	if err != nil {
+		return err
+	}
+	oldTimestamp := time.Now()
+	newTimestamp := oldTimestamp.Add(time.Duration(*queryInterval * float64(time.Second)))
+	oldSnapshots := newSnapshotBuffer(getSnapshotBufferCapacity(sidecarRules, *queryInterval))
+	oldSnapshots.add(newPrometheusSnapshot(replaceHistogramSummaryToGauge(oldPrometheusMetrics), oldTimestamp))
+	newSnapshot := newPrometheusSnapshot(replaceHistogramSummaryToGauge(newPrometheusMetrics), newTimestamp)
+	_, err = io.WriteString(stdout, convertMetricFamiliesIntoTextString(calculateSidecarRules(sidecarRules, newSnapshot, oldSnapshots)))
+	return err
+}
+
+func readPrometheusMetricsFile(prometheusMetricsFile string) ([]*prometheusClient.MetricFamily, error) {
+	content, err := ioutil.ReadFile(prometheusMetricsFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading prometheus metrics file: %v", err)
+	}
+	prometheusMetrics, err := parsePrometheusMetricsToMetricFamilies(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing prometheus metrics file %v: %v", prometheusMetricsFile, err)
+	}
+	return prometheusMetrics, nil
+}
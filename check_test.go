@@ -0,0 +1,48 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRunCheck(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	err := runCheck([]string{"--rules", "testdata/check/rules.yaml", "--before", "testdata/check/before.prom", "--after", "testdata/check/after.prom", "--interval", "10"}, stdout)
+	assert.NoError(t, err)
+	// (30 - 25) / 10 = 0.5
+	// (1.5 - 0.5) / 10 = 0.1
+	// 0.1 / 0.5 = 0.2
+	expectedString := `# HELP request_count_rate request_count_rate
+# TYPE request_count_rate gauge
+request_count_rate{method="GET",path="/rest/metrics"} 0.5
+# HELP request_total_time_rate request_total_time_rate
+# TYPE request_total_time_rate gauge
+request_total_time_rate{method="GET",path="/rest/metrics"} 0.1
+# HELP request_time_per_request request_time_per_request
+# TYPE request_time_per_request gauge
+request_time_per_request{method="GET",path="/rest/metrics"} 0.2
+`
+	assert.Equal(t, expectedString, stdout.String())
+}
+
+func TestRunCheckOnlyRules(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	assert.NoError(t, runCheck([]string{"--rules", "testdata/check/rules.yaml"}, stdout))
+	assert.Equal(t, "3 sidecar rules are valid\n", stdout.String())
+}
+
+func TestRunCheckWithInvalidArguments(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	err := runCheck([]string{"--rules", "testdata/check/invalid_rules.yaml"}, stdout)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "2 invalid sidecar rules")
+
+	assert.Error(t, runCheck([]string{}, stdout))
+	assert.Error(t, runCheck([]string{"--rules", "testdata/check/rules.yaml", "--before", "testdata/check/before.prom"}, stdout))
+	assert.Error(t, runCheck([]string{"--rules", "testdata/check/rules.yaml", "--before", "testdata/check/missing.prom", "--after", "testdata/check/after.prom"}, stdout))
+	assert.Error(t, runCheck([]string{"--rules", "testdata/check/rules.yaml", "--interval", "0"}, stdout))
+	assert.Equal(t, "", stdout.String())
+}
@@ -0,0 +1,164 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	log "github.hpe.com/kronos/kelog"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// getConfigFile returns the path of the standalone config file from the -config flag or the
+// SIDECAR_CONFIG_FILE environment variable, or "" to read the annotations of the pod.
+func getConfigFile(arguments []string) (string, error) {
+	flags := flag.NewFlagSet("monasca-sidecar", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("SIDECAR_CONFIG_FILE"), "YAML file with the sidecar annotations, to run without Kubernetes")
+	if err := flags.Parse(arguments); err != nil {
+		return "", err
+	}
+	return *configFile, nil
+}
+
+// loadAnnotationsFromFile reads a YAML file with the same keys as the pod annotations. Values can be
+// plain YAML values instead of strings, e.g. sidecar/rules can be a list of rules.
+func loadAnnotationsFromFile(configFile string) (map[string]string, error) {
+	content, errRead := ioutil.ReadFile(configFile)
+	if errRead != nil {
+		return nil, fmt.Errorf("error reading config file %v: %v", configFile, errRead)
+	}
+	return parseYamlAnnotations(content)
+}
+
+func parseYamlAnnotations(content []byte) (map[string]string, error) {
+	config := map[string]interface{}{}
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("error parsing config file: %v", err)
+	}
+	annotations := map[string]string{}
+	for key, value := range config {
+		switch v := value.(type) {
+		case nil:
+			annotations[key] = ""
+		case string:
+			annotations[key] = v
+		case bool, int, float64:
+			annotations[key] = fmt.Sprint(v)
+		default:
+			// lists and maps such as sidecar/rules are kept as YAML text like in an annotation
+			text, err := yaml.Marshal(v)
+			if err != nil {
+				return nil, fmt.Errorf("error converting %v of config file: %v", key, err)
+			}
+			annotations[key] = string(text)
+		}
+	}
+	return annotations, nil
+}
+
+// sidecarConfig holds everything the sidecar reads from annotations. It is replaced as a whole when
+// the annotations change.
+type sidecarConfig struct {
+	prometheusUrl string
+	sidecarRules  []SidecarRule
+	queryInterval float64
+	listenPort    string
+	listenPath    string
+	// push the calculated metrics to the Monasca API when set
+	monascaUrl  string
+	keystoneUrl string
+	// push the calculated metrics, and the scraped ones with passthrough, to a remote_write endpoint when set
+	remoteWriteUrl         string
+	remoteWritePassthrough bool
+	remoteWriteMaxRetries  int
+}
+
+func parseSidecarConfig(annotations map[string]string) (sidecarConfig, error) {
+	prometheusUrl, succeedFlag := getPrometheusUrl(annotations)
+	if !succeedFlag {
+		return sidecarConfig{}, fmt.Errorf("error getting prometheus URL")
+	}
+
+	//get sidecar specific input parameters
+	queryIntervalString := annotations["sidecar/query-interval"]
+	if queryIntervalString == "" {
+		return sidecarConfig{}, fmt.Errorf("sidecar/query-interval can not be empty")
+	}
+	queryInterval, errParseFloat := strconv.ParseFloat(queryIntervalString, 64)
+	if queryInterval <= 0.0 || errParseFloat != nil {
+		log.Warnf("Error converting \"sidecar/query-interval\": %v. Set queryInterval to default 30.0 seconds.", errParseFloat)
+		queryInterval = 30.0
+	}
+
+	listenPort := annotations["prometheus.io/port"]
+	if listenPort == "" {
+		return sidecarConfig{}, fmt.Errorf("prometheus.io/port can not be empty")
+	}
+	listenPath := annotations["prometheus.io/path"]
+	if listenPath == "" {
+		listenPath = "/metrics"
+		log.Infof("\"prometheus.io/path\" is empty, set to default \"/metrics\".")
+	}
+	if !strings.HasPrefix(listenPath, "/") {
+		listenPath = "/" + listenPath
+	}
+
+	rules := annotations["sidecar/rules"]
+	if rules == "" {
+		return sidecarConfig{}, fmt.Errorf("sidecar/rules can not be empty")
+	}
+	log.Infof("rules = %s\n", rules)
+	sidecarRules, errRules := unmarshalSidecarRules(rules)
+	if errRules != nil {
+		return sidecarConfig{}, fmt.Errorf("error parsing sidecar rules: %v", errRules)
+	}
+	if errValidate := validateSidecarRules(sidecarRules); errValidate != nil {
+		return sidecarConfig{}, errValidate
+	}
+	sidecarRules, errSort := sortSidecarRulesByDependency(sidecarRules)
+	if errSort != nil {
+		return sidecarConfig{}, fmt.Errorf("error ordering sidecar rules: %v", errSort)
+	}
+
+	monascaUrl := annotations["sidecar/monasca-url"]
+	keystoneUrl := annotations["sidecar/keystone-url"]
+	if monascaUrl != "" && keystoneUrl == "" {
+		return sidecarConfig{}, fmt.Errorf("sidecar/keystone-url can not be empty when sidecar/monasca-url is set")
+	}
+
+	remoteWriteUrl := annotations["sidecar/remote-write-url"]
+	remoteWritePassthrough := false
+	if passthrough, ok := annotations["sidecar/remote-write-passthrough"]; ok {
+		var errParseBool error
+		remoteWritePassthrough, errParseBool = strconv.ParseBool(passthrough)
+		if errParseBool != nil {
+			return sidecarConfig{}, fmt.Errorf("invalid sidecar/remote-write-passthrough %v", passthrough)
+		}
+	}
+	remoteWriteMaxRetries := remoteWriteMaxRetries
+	if maxRetries, ok := annotations["sidecar/remote-write-max-retries"]; ok {
+		var errAtoi error
+		remoteWriteMaxRetries, errAtoi = strconv.Atoi(maxRetries)
+		if errAtoi != nil || remoteWriteMaxRetries < 0 {
+			return sidecarConfig{}, fmt.Errorf("invalid sidecar/remote-write-max-retries %v", maxRetries)
+		}
+	}
+
+	return sidecarConfig{
+		prometheusUrl: prometheusUrl,
+		sidecarRules:  sidecarRules,
+		queryInterval: queryInterval,
+		listenPort:    listenPort,
+		listenPath:    listenPath,
+		monascaUrl:    monascaUrl,
+		keystoneUrl:   keystoneUrl,
+
+		remoteWriteUrl:         remoteWriteUrl,
+		remoteWritePassthrough: remoteWritePassthrough,
+		remoteWriteMaxRetries:  remoteWriteMaxRetries,
+	}, nil
+}
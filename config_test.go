@@ -0,0 +1,126 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLoadAnnotationsFromFile(t *testing.T) {
+	configFile, err := ioutil.TempFile("", "sidecar-config")
+	assert.NoError(t, err)
+	defer os.Remove(configFile.Name())
+	_, err = configFile.WriteString(`
+prometheus.io/path: /metrics
+prometheus.io/port: 9999
+prometheus.io/scrape: true
+sidecar/query-interval: 30
+sidecar/host: app
+sidecar/port: "5556"
+sidecar/rules:
+- metricName: request_count_rate
+  function: rate
+  parameters:
+    name: request_count
+`)
+	assert.NoError(t, err)
+	configFile.Close()
+
+	annotations, err := loadAnnotationsFromFile(configFile.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, "/metrics", annotations["prometheus.io/path"])
+	assert.Equal(t, "9999", annotations["prometheus.io/port"])
+	assert.Equal(t, "true", annotations["prometheus.io/scrape"])
+	assert.Equal(t, "30", annotations["sidecar/query-interval"])
+	assert.Equal(t, "5556", annotations["sidecar/port"])
+
+	sidecarRules, errUnmarshal := unmarshalSidecarRules(annotations["sidecar/rules"])
+	assert.NoError(t, errUnmarshal)
+	assert.Equal(t, 1, len(sidecarRules))
+	assert.Equal(t, "request_count_rate", sidecarRules[0].Name)
+	assert.Equal(t, "request_count", sidecarRules[0].Parameters["name"])
+
+	prometheusUrl, succeed := getPrometheusUrl(annotations)
+	assert.True(t, succeed)
+	assert.Equal(t, "http://app:5556/metrics", prometheusUrl)
+}
+
+func TestLoadAnnotationsFromMissingFile(t *testing.T) {
+	_, err := loadAnnotationsFromFile("/does/not/exist.yaml")
+	assert.Error(t, err)
+	_, err = parseYamlAnnotations([]byte("- not a map"))
+	assert.Error(t, err)
+}
+
+func TestGetConfigFile(t *testing.T) {
+	configFile, err := getConfigFile([]string{"-config", "/etc/sidecar/config.yaml"})
+	assert.NoError(t, err)
+	assert.Equal(t, "/etc/sidecar/config.yaml", configFile)
+
+	os.Setenv("SIDECAR_CONFIG_FILE", "/etc/sidecar/env.yaml")
+	defer os.Unsetenv("SIDECAR_CONFIG_FILE")
+	configFile, err = getConfigFile([]string{})
+	assert.NoError(t, err)
+	assert.Equal(t, "/etc/sidecar/env.yaml", configFile)
+
+	_, err = getConfigFile([]string{"-unknown"})
+	assert.Error(t, err)
+}
+
+func TestParseSidecarConfig(t *testing.T) {
+	annotations := map[string]string{}
+	annotations["prometheus.io/scrape"] = "true"
+	annotations["prometheus.io/port"] = "9999"
+	annotations["prometheus.io/path"] = "sidecar/metrics"
+	annotations["sidecar/port"] = "5556"
+	annotations["sidecar/query-interval"] = "not a number"
+	annotations["sidecar/rules"] = `
+- metricName: request_count_rate
+  function: rate
+  parameters:
+    name: request_count`
+	config, err := parseSidecarConfig(annotations)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost:5556/metrics", config.prometheusUrl)
+	assert.Equal(t, 30.0, config.queryInterval)
+	assert.Equal(t, "9999", config.listenPort)
+	assert.Equal(t, "/sidecar/metrics", config.listenPath)
+	assert.Equal(t, 1, len(config.sidecarRules))
+	assert.Equal(t, "", config.monascaUrl)
+
+	// pushing to monasca needs keystone to get a token
+	annotations["sidecar/monasca-url"] = "http://monasca:8070"
+	_, err = parseSidecarConfig(annotations)
+	assert.Error(t, err)
+	annotations["sidecar/keystone-url"] = "http://keystone:5000/v3"
+	config, err = parseSidecarConfig(annotations)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://monasca:8070", config.monascaUrl)
+	assert.Equal(t, "http://keystone:5000/v3", config.keystoneUrl)
+
+	assert.Equal(t, "", config.remoteWriteUrl)
+	assert.Equal(t, remoteWriteMaxRetries, config.remoteWriteMaxRetries)
+	annotations["sidecar/remote-write-url"] = "http://cortex/api/v1/push"
+	annotations["sidecar/remote-write-passthrough"] = "true"
+	annotations["sidecar/remote-write-max-retries"] = "5"
+	config, err = parseSidecarConfig(annotations)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://cortex/api/v1/push", config.remoteWriteUrl)
+	assert.True(t, config.remoteWritePassthrough)
+	assert.Equal(t, 5, config.remoteWriteMaxRetries)
+	annotations["sidecar/remote-write-max-retries"] = "-1"
+	_, err = parseSidecarConfig(annotations)
+	assert.Error(t, err)
+	annotations["sidecar/remote-write-max-retries"] = "5"
+	annotations["sidecar/remote-write-passthrough"] = "sometimes"
+	_, err = parseSidecarConfig(annotations)
+	assert.Error(t, err)
+	delete(annotations, "sidecar/remote-write-passthrough")
+
+	delete(annotations, "prometheus.io/port")
+	_, err = parseSidecarConfig(annotations)
+	assert.Error(t, err)
+}
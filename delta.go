@@ -7,15 +7,41 @@ import (
 	log "github.hpe.com/kronos/kelog"
 )
 
-func calculateDelta(newPrometheusMetrics []*prometheusClient.MetricFamily, oldPrometheusMetrics []*prometheusClient.MetricFamily, rule SidecarRule) []*prometheusClient.MetricFamily {
+func init() {
+	registerRuleFunction("delta", deltaFunction{})
+}
+
+type deltaFunction struct{}
+
+func (deltaFunction) ValidateParameters(rule SidecarRule) error {
+	if err := checkRequiredParameters(rule, "name"); err != nil {
+		return err
+	}
+	if err := checkBoolParameters(rule, "compensateCounterReset"); err != nil {
+		return err
+	}
+	return checkDurationParameters(rule, "window")
+}
+
+func (deltaFunction) Calculate(newSnapshot prometheusSnapshot, oldSnapshot prometheusSnapshot, rule SidecarRule) []*prometheusClient.MetricFamily {
+	return calculateDelta(newSnapshot, oldSnapshot, rule)
+}
+
+func (deltaFunction) CalculateWindow(snapshots []prometheusSnapshot, rule SidecarRule) []*prometheusClient.MetricFamily {
+	newDeltaMetrics := []*prometheusClient.MetricFamily{}
+	for _, windowIncrease := range getWindowIncreases(snapshots, rule.Parameters["name"], rule) {
+		newDeltaMetrics = append(newDeltaMetrics, createNewMetricFamilies(rule.Name, windowIncrease.labels, windowIncrease.increase))
+	}
+	log.Debugf("Successfully calculated delta over window for rule %v", rule.Name)
+	return newDeltaMetrics
+}
+
+func calculateDelta(newSnapshot prometheusSnapshot, oldSnapshot prometheusSnapshot, rule SidecarRule) []*prometheusClient.MetricFamily {
 	newDeltaMetrics := []*prometheusClient.MetricFamily{}
 	// find old value and new value
-	for _, pm := range newPrometheusMetrics {
-		if *pm.Name != rule.Parameters["name"] {
-			continue
-		}
+	for _, pm := range selectMetricFamilies(newSnapshot.metrics, rule.Parameters["name"]) {
 		for _, newM := range pm.Metric {
-			oldValueFloat, succeedOld := findOldValueWithMetricFamily(oldPrometheusMetrics, newM, *pm.Name, *pm.Type)
+			oldValueFloat, succeedOld := oldSnapshot.index.findValue(*pm.Name, *pm.Type, newM.Label)
 			if succeedOld {
 				// calculate delta
 				newValueFloat, succeedNew := getValueBasedOnType(*pm.Type, *newM)
@@ -23,11 +49,11 @@ func calculateDelta(newPrometheusMetrics []*prometheusClient.MetricFamily, oldPr
 					log.Warnf("Error getting values from new prometheus metric: %v", *pm.Name)
 					continue
 				}
-				if *pm.Type == prometheusClient.MetricType_COUNTER && newValueFloat < oldValueFloat {
+				delta, succeedIncrease := getIncrease(*pm.Type, newValueFloat, oldValueFloat, rule)
+				if !succeedIncrease {
 					log.Warnf("Counter %v has been reset", *pm.Name)
 					continue
 				}
-				delta := newValueFloat - oldValueFloat
 
 				// store delta metric into a new metric family
 				newDeltaMetrics = append(newDeltaMetrics, createNewMetricFamilies(rule.Name, newM.Label, delta))
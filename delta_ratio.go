@@ -7,16 +7,69 @@ import (
 	log "github.hpe.com/kronos/kelog"
 )
 
-func calculateDeltaRatio(newPrometheusMetrics []*prometheusClient.MetricFamily, oldPrometheusMetrics []*prometheusClient.MetricFamily, rule SidecarRule) []*prometheusClient.MetricFamily {
-	// deltaRatio = (newNumeratorValue - oldNumeratorValue) / (newDenominatorValue - oldDenominatorValue)
+func init() {
+	registerRuleFunction("deltaRatio", deltaRatioFunction{})
+}
+
+type deltaRatioFunction struct{}
+
+func (deltaRatioFunction) ValidateParameters(rule SidecarRule) error {
+	if err := checkRequiredParameters(rule, "numerator", "denominator"); err != nil {
+		return err
+	}
+	if err := checkBoolParameters(rule, "compensateCounterReset"); err != nil {
+		return err
+	}
+	if err := checkDurationParameters(rule, "window"); err != nil {
+		return err
+	}
+	return validateVectorMatching(rule)
+}
+
+func (deltaRatioFunction) Calculate(newSnapshot prometheusSnapshot, oldSnapshot prometheusSnapshot, rule SidecarRule) []*prometheusClient.MetricFamily {
+	return calculateDeltaRatio(newSnapshot, oldSnapshot, rule)
+}
+
+func (deltaRatioFunction) CalculateWindow(snapshots []prometheusSnapshot, rule SidecarRule) []*prometheusClient.MetricFamily {
 	newDeltaRatioMetrics := []*prometheusClient.MetricFamily{}
-	// find old value and new value
-	for _, pm := range newPrometheusMetrics {
-		if *pm.Name != rule.Parameters["numerator"] {
+	numeratorName, denominatorName := rule.Parameters["numerator"], rule.Parameters["denominator"]
+	numerators := getWindowIncreases(snapshots, numeratorName, rule)
+	if hasVectorMatching(rule) {
+		return calculateRatioWithVectorMatching(getWindowVectorSamples(numerators), getWindowVectorSamples(getWindowIncreases(snapshots, denominatorName, rule)), rule)
+	}
+	for _, numerator := range numerators {
+		labels := numerator.labels
+		denominatorIncrease, _, succeedDenominator := getSeriesWindowIncrease(snapshots, denominatorName, rule, func(index *metricIndex) (indexedMetric, bool) {
+			return index.findDenominatorMetric(denominatorName, labels)
+		})
+		if !succeedDenominator {
+			log.Warnf("Error getting denominator %v over window for labels %v", denominatorName, labels)
 			continue
 		}
+		if denominatorIncrease == 0.0 {
+			log.Infof("Delta value of denominator from metric %v with labels %v cannot be zero", numeratorName, labels)
+			continue
+		}
+		newDeltaRatioMetrics = append(newDeltaRatioMetrics, createNewMetricFamilies(rule.Name, labels, numerator.increase/denominatorIncrease))
+	}
+	log.Debugf("Successfully calculated deltaRatio over window for rule %v", rule.Name)
+	return newDeltaRatioMetrics
+}
+
+func calculateDeltaRatio(newSnapshot prometheusSnapshot, oldSnapshot prometheusSnapshot, rule SidecarRule) []*prometheusClient.MetricFamily {
+	// deltaRatio = (newNumeratorValue - oldNumeratorValue) / (newDenominatorValue - oldDenominatorValue)
+	if hasVectorMatching(rule) {
+		deltaNumerators := getDeltaVectorSamples(newSnapshot, oldSnapshot, rule.Parameters["numerator"], rule)
+		deltaDenominators := getDeltaVectorSamples(newSnapshot, oldSnapshot, rule.Parameters["denominator"], rule)
+		newDeltaRatioMetrics := calculateRatioWithVectorMatching(deltaNumerators, deltaDenominators, rule)
+		log.Debugf("Successfully calculated deltaRatio with vector matching for rule %v", rule.Name)
+		return newDeltaRatioMetrics
+	}
+	newDeltaRatioMetrics := []*prometheusClient.MetricFamily{}
+	// find old value and new value
+	for _, pm := range selectMetricFamilies(newSnapshot.metrics, rule.Parameters["numerator"]) {
 		for _, newM := range pm.Metric {
-			oldNumeratorValueFloat, succeedOldNumerator := findOldValueWithMetricFamily(oldPrometheusMetrics, newM, *pm.Name, *pm.Type)
+			oldNumeratorValueFloat, succeedOldNumerator := oldSnapshot.index.findValue(*pm.Name, *pm.Type, newM.Label)
 			if succeedOldNumerator {
 				// calculate deltaNumeratorValue
 				newNumeratorValueFloat, succeedNewNumerator := getValueBasedOnType(*pm.Type, *newM)
@@ -24,29 +77,35 @@ func calculateDeltaRatio(newPrometheusMetrics []*prometheusClient.MetricFamily,
 					log.Warnf("Error getting new numerator value from new prometheus metric: %v", *pm.Name)
 					continue
 				}
-				if *pm.Type == prometheusClient.MetricType_COUNTER && newNumeratorValueFloat < oldNumeratorValueFloat {
+				deltaNumeratorValue, succeedNumeratorIncrease := getIncrease(*pm.Type, newNumeratorValueFloat, oldNumeratorValueFloat, rule)
+				if !succeedNumeratorIncrease {
 					log.Warnf("Counter %v has been reset", rule.Parameters["numerator"])
 					continue
 				}
-				deltaNumeratorValue := newNumeratorValueFloat - oldNumeratorValueFloat
 
 				// get new denominator value
-				newDenominatorValueFloat, succeedNewDenominator := findDenominatorValue(newPrometheusMetrics, newM.Label, rule.Parameters["denominator"])
+				newDenominator, succeedNewDenominator := newSnapshot.index.findDenominatorMetric(rule.Parameters["denominator"], newM.Label)
 				if !succeedNewDenominator {
 					log.Warnf("Error getting new denominator value from new prometheus metric: %v", *pm.Name)
 					continue
 				}
+				newDenominatorValueFloat, succeedNewDenominatorValue := getValueBasedOnType(newDenominator.metricType, *newDenominator.metric)
+				if !succeedNewDenominatorValue {
+					log.Warnf("Error getting new denominator value from new prometheus metric: %v", rule.Parameters["denominator"])
+					continue
+				}
 				// get old denominator value
-				oldDenominatorValueFloat, succeedOldDenominator := findDenominatorValue(oldPrometheusMetrics, newM.Label, rule.Parameters["denominator"])
+				oldDenominatorValueFloat, succeedOldDenominator := oldSnapshot.index.findDenominatorValue(rule.Parameters["denominator"], newM.Label)
 				if !succeedOldDenominator {
 					log.Warnf("Error getting old denominator value from old prometheus metric: %v", *pm.Name)
 					continue
 				}
-				if *pm.Type == prometheusClient.MetricType_COUNTER && newDenominatorValueFloat < oldDenominatorValueFloat {
+				// the denominator may be a counter while the numerator is a gauge, or the other way around
+				deltaDenominatorValue, succeedDenominatorIncrease := getIncrease(newDenominator.metricType, newDenominatorValueFloat, oldDenominatorValueFloat, rule)
+				if !succeedDenominatorIncrease {
 					log.Warnf("Counter %v has been reset", rule.Parameters["denominator"])
 					continue
 				}
-				deltaDenominatorValue := newDenominatorValueFloat - oldDenominatorValueFloat
 				if deltaDenominatorValue == 0.0 {
 					log.Infof("Delta value of denominator from metric %v with labels %v cannot be zero", *pm.Name, newM.Label)
 					continue
@@ -41,7 +41,7 @@ request_total_time{method="POST",path="/rest/support"} 1.2
 
 	// (0.9 - 0.5) / (30 - 25) = 0.08
 	// (1.2 - 0.7) / (20 - 10) = 0.05
-	deltaRatioMetricFamilies := calculateDeltaRatio(newMetricFamilies, oldMetricFamilies, deltaRatioRule)
+	deltaRatioMetricFamilies := calculateDeltaRatio(newTestSnapshot(newMetricFamilies, 30), newTestSnapshot(oldMetricFamilies, 0), deltaRatioRule)
 	deltaRatioMetricString := convertMetricFamiliesIntoTextString(deltaRatioMetricFamilies)
 	expectedDeltaRatioMetricString := `# HELP deltaRatioRuleTestName deltaRatioRuleTestName
 # TYPE deltaRatioRuleTestName gauge
@@ -86,7 +86,7 @@ request_total_time{method="POST",path="/rest/support/2"} 1.0
 	deltaRatioRule := SidecarRule{Name: "deltaRatioRuleTestName", Function: "deltaRatio", Parameters: deltaRatioRuleParam}
 
 	// mismatch dimensions
-	deltaRatioMetricFamilies := calculateDeltaRatio(newMetricFamilies, oldMetricFamilies, deltaRatioRule)
+	deltaRatioMetricFamilies := calculateDeltaRatio(newTestSnapshot(newMetricFamilies, 30), newTestSnapshot(oldMetricFamilies, 0), deltaRatioRule)
 	assert.Equal(t, 0, len(deltaRatioMetricFamilies))
 }
 
@@ -129,7 +129,7 @@ http_request_dudeltaRation_seconds_count 149320
 	deltaRatioRuleParam["denominator"] = "http_request_dudeltaRation_seconds_sum"
 	deltaRatioRule := SidecarRule{Name: "deltaRatioRuleTestHistogramName", Function: "deltaRatio", Parameters: deltaRatioRuleParam}
 
-	deltaRatioMetricFamilies := calculateDeltaRatio(newPrometheusMetricsWithNoHistogramSummary, oldPrometheusMetricsWithNoHistogramSummary, deltaRatioRule)
+	deltaRatioMetricFamilies := calculateDeltaRatio(newTestSnapshot(newPrometheusMetricsWithNoHistogramSummary, 30), newTestSnapshot(oldPrometheusMetricsWithNoHistogramSummary, 0), deltaRatioRule)
 	deltaRatioMetricString := convertMetricFamiliesIntoTextString(deltaRatioMetricFamilies)
 
 	// (149320 - 144320) / (63423 - 53423) = 0.5
@@ -169,7 +169,7 @@ request_total_time{method="GET",path="/rest/metrics"} 0.6
 	deltaRatioRule := SidecarRule{Name: "deltaRatioRuleTestName", Function: "deltaRatio", Parameters: deltaRatioRuleParam}
 
 	// (0.6 - 0.5) / (25 - 25) = +Inf
-	deltaRatioMetricFamilies := calculateDeltaRatio(newMetricFamilies, oldMetricFamilies, deltaRatioRule)
+	deltaRatioMetricFamilies := calculateDeltaRatio(newTestSnapshot(newMetricFamilies, 30), newTestSnapshot(oldMetricFamilies, 0), deltaRatioRule)
 	deltaRatioMetricString := convertMetricFamiliesIntoTextString(deltaRatioMetricFamilies)
 	assert.Equal(t, "", deltaRatioMetricString)
 }
@@ -203,7 +203,7 @@ request_total_time{method="GET",path="/rest/metrics"} 0.5
 	deltaRatioRule := SidecarRule{Name: "deltaRatioRuleTestName", Function: "deltaRatio", Parameters: deltaRatioRuleParam}
 
 	// (0.5 - 0.5) / (25 - 24) = 0
-	deltaRatioMetricFamilies := calculateDeltaRatio(newMetricFamilies, oldMetricFamilies, deltaRatioRule)
+	deltaRatioMetricFamilies := calculateDeltaRatio(newTestSnapshot(newMetricFamilies, 30), newTestSnapshot(oldMetricFamilies, 0), deltaRatioRule)
 	deltaRatioMetricString := convertMetricFamiliesIntoTextString(deltaRatioMetricFamilies)
 	expectedDeltaRatioMetricString := `# HELP deltaRatioRuleTestName deltaRatioRuleTestName
 # TYPE deltaRatioRuleTestName gauge
@@ -241,7 +241,7 @@ request_total_time{method="GET",path="/rest/metrics"} 0.5
 	deltaRatioRule := SidecarRule{Name: "deltaRatioRuleTestName", Function: "deltaRatio", Parameters: deltaRatioRuleParam}
 
 	// (0.5 - 0.5) / (25 - 25) = NaN
-	deltaRatioMetricFamilies := calculateDeltaRatio(newMetricFamilies, oldMetricFamilies, deltaRatioRule)
+	deltaRatioMetricFamilies := calculateDeltaRatio(newTestSnapshot(newMetricFamilies, 30), newTestSnapshot(oldMetricFamilies, 0), deltaRatioRule)
 	deltaRatioMetricString := convertMetricFamiliesIntoTextString(deltaRatioMetricFamilies)
 	assert.Equal(t, "", deltaRatioMetricString)
 }
@@ -275,10 +275,49 @@ request_total_time{method="GET",path="/rest/metrics"} 0.1
 	deltaRatioRule := SidecarRule{Name: "deltaRatioRuleTestName", Function: "deltaRatio", Parameters: deltaRatioRuleParam}
 
 	// test resetting counters
-	deltaRatioMetricFamilies := calculateDeltaRatio(newMetricFamilies, oldMetricFamilies, deltaRatioRule)
+	deltaRatioMetricFamilies := calculateDeltaRatio(newTestSnapshot(newMetricFamilies, 30), newTestSnapshot(oldMetricFamilies, 0), deltaRatioRule)
 	assert.Equal(t, 0, len(deltaRatioMetricFamilies))
 }
 
+func TestCalculateDeltaRatioWithCompensatedCounterReset(t *testing.T) {
+	oldPrometheusMetricsString := `
+# HELP request_count Counts requests by method and path
+# TYPE request_count counter
+request_count{method="GET",path="/rest/metrics"} 25
+# HELP request_total_time Total time in second requests take by method and path
+# TYPE request_total_time counter
+request_total_time{method="GET",path="/rest/metrics"} 0.5
+`
+	newPrometheusMetricsString := `
+# HELP request_count Counts requests by method and path
+# TYPE request_count counter
+request_count{method="GET",path="/rest/metrics"} 5
+# HELP request_total_time Total time in second requests take by method and path
+# TYPE request_total_time counter
+request_total_time{method="GET",path="/rest/metrics"} 0.2
+`
+	oldMetricFamilies, errOldMF := parsePrometheusMetricsToMetricFamilies(oldPrometheusMetricsString)
+	newMetricFamilies, errNewMF := parsePrometheusMetricsToMetricFamilies(newPrometheusMetricsString)
+	assert.NoError(t, errOldMF)
+	assert.NoError(t, errNewMF)
+
+	// define deltaRatioRule
+	deltaRatioRuleParam := map[string]string{}
+	deltaRatioRuleParam["numerator"] = "request_total_time"
+	deltaRatioRuleParam["denominator"] = "request_count"
+	deltaRatioRuleParam["compensateCounterReset"] = "true"
+	deltaRatioRule := SidecarRule{Name: "deltaRatioRuleTestName", Function: "deltaRatio", Parameters: deltaRatioRuleParam}
+
+	// both counters have been reset: 0.2 / 5 = 0.04
+	deltaRatioMetricFamilies := calculateDeltaRatio(newTestSnapshot(newMetricFamilies, 30), newTestSnapshot(oldMetricFamilies, 0), deltaRatioRule)
+	deltaRatioMetricString := convertMetricFamiliesIntoTextString(deltaRatioMetricFamilies)
+	expectedDeltaRatioMetricString := `# HELP deltaRatioRuleTestName deltaRatioRuleTestName
+# TYPE deltaRatioRuleTestName gauge
+deltaRatioRuleTestName{method="GET",path="/rest/metrics"} 0.04
+`
+	assert.Equal(t, expectedDeltaRatioMetricString, deltaRatioMetricString)
+}
+
 func TestDeltaRatioWithRequstBucketCount(t *testing.T) {
 	oldPrometheusMetricsString := `# HELP request_bucket_count Histogram count of requests by method, path (seconds), bucket
 # TYPE request_bucket_count counter
@@ -315,7 +354,7 @@ request_count{method="GET",path="/rest/metrics"} 4
 	deltaRatioRule := SidecarRule{Name: "requestBucketCountRatioTestName", Function: "deltaRatio", Parameters: deltaRatioRuleParam}
 
 	// delta ratio
-	deltaRatioMetricFamilies := calculateDeltaRatio(newMetricFamilies, oldMetricFamilies, deltaRatioRule)
+	deltaRatioMetricFamilies := calculateDeltaRatio(newTestSnapshot(newMetricFamilies, 30), newTestSnapshot(oldMetricFamilies, 0), deltaRatioRule)
 	deltaRatioMetricString := convertMetricFamiliesIntoTextString(deltaRatioMetricFamilies)
 	expectedResult := `# HELP requestBucketCountRatioTestName requestBucketCountRatioTestName
 # TYPE requestBucketCountRatioTestName gauge
@@ -332,3 +371,41 @@ requestBucketCountRatioTestName{ge="2.5",method="GET",path="/rest/metrics"} 0.5
 `
 	assert.Equal(t, expectedResult, deltaRatioMetricString)
 }
+
+func TestCalculateDeltaRatioWithDenominatorOfOtherType(t *testing.T) {
+	oldMetricFamilies, errOldMF := parsePrometheusMetricsToMetricFamilies(`
+# HELP queue_depth Number of queued requests
+# TYPE queue_depth gauge
+queue_depth{method="GET"} 5
+# HELP request_count Counts requests by method
+# TYPE request_count counter
+request_count{method="GET"} 100
+`)
+	newMetricFamilies, errNewMF := parsePrometheusMetricsToMetricFamilies(`
+# HELP queue_depth Number of queued requests
+# TYPE queue_depth gauge
+queue_depth{method="GET"} 8
+# HELP request_count Counts requests by method
+# TYPE request_count counter
+request_count{method="GET"} 40
+`)
+	assert.NoError(t, errOldMF)
+	assert.NoError(t, errNewMF)
+	deltaRatioRuleParam := map[string]string{}
+	deltaRatioRuleParam["numerator"] = "queue_depth"
+	deltaRatioRuleParam["denominator"] = "request_count"
+	deltaRatioRule := SidecarRule{Name: "deltaRatioRuleTestName", Function: "deltaRatio", Parameters: deltaRatioRuleParam}
+
+	// the denominator counter has been reset although the numerator is a gauge
+	deltaRatioMetricFamilies := calculateDeltaRatio(newTestSnapshot(newMetricFamilies, 30), newTestSnapshot(oldMetricFamilies, 0), deltaRatioRule)
+	assert.Equal(t, 0, len(deltaRatioMetricFamilies))
+
+	// (8 - 5) / 40 = 0.075
+	deltaRatioRuleParam["compensateCounterReset"] = "true"
+	deltaRatioMetricString := convertMetricFamiliesIntoTextString(calculateDeltaRatio(newTestSnapshot(newMetricFamilies, 30), newTestSnapshot(oldMetricFamilies, 0), deltaRatioRule))
+	expectedDeltaRatioMetricString := `# HELP deltaRatioRuleTestName deltaRatioRuleTestName
+# TYPE deltaRatioRuleTestName gauge
+deltaRatioRuleTestName{method="GET"} 0.075
+`
+	assert.Equal(t, expectedDeltaRatioMetricString, deltaRatioMetricString)
+}
@@ -40,7 +40,7 @@ request_total_time{method="POST",path="/rest/support"} 1.0
 
 	// 30 - 25 = 5
 	// 20 - 10 = 10
-	deltaMetricFamilies := calculateDelta(newMetricFamilies, oldMetricFamilies, deltaRule)
+	deltaMetricFamilies := calculateDelta(newTestSnapshot(newMetricFamilies, 30), newTestSnapshot(oldMetricFamilies, 0), deltaRule)
 	deltaMetricString := convertMetricFamiliesIntoTextString(deltaMetricFamilies)
 	expectedDeltaMetricString := `# HELP deltaRuleTestName deltaRuleTestName
 # TYPE deltaRuleTestName gauge
@@ -75,7 +75,7 @@ request_count{method="POST",path="/rest/support/2"} 20
 	deltaRuleParam["name"] = "request_count"
 	deltaRule := SidecarRule{Name: "deltaRuleTestName", Function: "delta", Parameters: deltaRuleParam}
 
-	deltaMetricFamilies := calculateDelta(newMetricFamilies, oldMetricFamilies, deltaRule)
+	deltaMetricFamilies := calculateDelta(newTestSnapshot(newMetricFamilies, 30), newTestSnapshot(oldMetricFamilies, 0), deltaRule)
 	assert.Equal(t, 0, len(deltaMetricFamilies))
 }
 
@@ -117,7 +117,7 @@ http_request_duration_seconds_count 149320
 	deltaRuleParam["name"] = "http_request_duration_seconds_bucket"
 	deltaRuleBucket := SidecarRule{Name: "deltaRuleTestHistogramName", Function: "delta", Parameters: deltaRuleParam}
 
-	deltaMetricFamiliesBucket := calculateDelta(newPrometheusMetricsWithNoHistogramSummary, oldPrometheusMetricsWithNoHistogramSummary, deltaRuleBucket)
+	deltaMetricFamiliesBucket := calculateDelta(newTestSnapshot(newPrometheusMetricsWithNoHistogramSummary, 30), newTestSnapshot(oldPrometheusMetricsWithNoHistogramSummary, 0), deltaRuleBucket)
 	deltaMetricStringBucket := convertMetricFamiliesIntoTextString(deltaMetricFamiliesBucket)
 
 	expectedResultBucket := `# HELP deltaRuleTestHistogramName deltaRuleTestHistogramName
@@ -145,7 +145,7 @@ deltaRuleTestHistogramName{le="1"} 2000
 	deltaRuleParam["name"] = "http_request_duration_seconds_sum"
 	deltaRuleSum := SidecarRule{Name: "deltaRuleTestHistogramName", Function: "delta", Parameters: deltaRuleParam}
 
-	deltaMetricFamiliesSum := calculateDelta(newPrometheusMetricsWithNoHistogramSummary, oldPrometheusMetricsWithNoHistogramSummary, deltaRuleSum)
+	deltaMetricFamiliesSum := calculateDelta(newTestSnapshot(newPrometheusMetricsWithNoHistogramSummary, 30), newTestSnapshot(oldPrometheusMetricsWithNoHistogramSummary, 0), deltaRuleSum)
 	deltaMetricStringSum := convertMetricFamiliesIntoTextString(deltaMetricFamiliesSum)
 
 	expectedResultSum := `# HELP deltaRuleTestHistogramName deltaRuleTestHistogramName
@@ -158,7 +158,7 @@ deltaRuleTestHistogramName 10000
 	deltaRuleParam["name"] = "http_request_duration_seconds_count"
 	deltaRuleCount := SidecarRule{Name: "deltaRuleTestHistogramName", Function: "delta", Parameters: deltaRuleParam}
 
-	deltaMetricFamiliesCount := calculateDelta(newPrometheusMetricsWithNoHistogramSummary, oldPrometheusMetricsWithNoHistogramSummary, deltaRuleCount)
+	deltaMetricFamiliesCount := calculateDelta(newTestSnapshot(newPrometheusMetricsWithNoHistogramSummary, 30), newTestSnapshot(oldPrometheusMetricsWithNoHistogramSummary, 0), deltaRuleCount)
 	deltaMetricStringCount := convertMetricFamiliesIntoTextString(deltaMetricFamiliesCount)
 
 	expectedResultCount := `# HELP deltaRuleTestHistogramName deltaRuleTestHistogramName
@@ -189,6 +189,38 @@ request_count{method="GET",path="/rest/metrics"} 5
 	deltaRuleParam["name"] = "request_count"
 	deltaRule := SidecarRule{Name: "deltaRuleTestName", Function: "delta", Parameters: deltaRuleParam}
 
-	deltaMetricFamilies := calculateDelta(newMetricFamilies, oldMetricFamilies, deltaRule)
+	deltaMetricFamilies := calculateDelta(newTestSnapshot(newMetricFamilies, 30), newTestSnapshot(oldMetricFamilies, 0), deltaRule)
 	assert.Equal(t, 0, len(deltaMetricFamilies))
 }
+
+func TestCalculateDeltaWithCompensatedCounterReset(t *testing.T) {
+	oldPrometheusMetricsString := `
+# HELP request_count Counts requests by method and path
+# TYPE request_count counter
+request_count{method="GET",path="/rest/metrics"} 25
+`
+	newPrometheusMetricsString := `
+# HELP request_count Counts requests by method and path
+# TYPE request_count counter
+request_count{method="GET",path="/rest/metrics"} 5
+`
+	oldMetricFamilies, errOldMF := parsePrometheusMetricsToMetricFamilies(oldPrometheusMetricsString)
+	newMetricFamilies, errNewMF := parsePrometheusMetricsToMetricFamilies(newPrometheusMetricsString)
+	assert.NoError(t, errOldMF)
+	assert.NoError(t, errNewMF)
+
+	// define deltaRule
+	deltaRuleParam := map[string]string{}
+	deltaRuleParam["name"] = "request_count"
+	deltaRuleParam["compensateCounterReset"] = "true"
+	deltaRule := SidecarRule{Name: "deltaRuleTestName", Function: "delta", Parameters: deltaRuleParam}
+
+	// counter has been reset, new value is the increase: 5
+	deltaMetricFamilies := calculateDelta(newTestSnapshot(newMetricFamilies, 30), newTestSnapshot(oldMetricFamilies, 0), deltaRule)
+	deltaMetricString := convertMetricFamiliesIntoTextString(deltaMetricFamilies)
+	expectedDeltaMetricString := `# HELP deltaRuleTestName deltaRuleTestName
+# TYPE deltaRuleTestName gauge
+deltaRuleTestName{method="GET",path="/rest/metrics"} 5
+`
+	assert.Equal(t, expectedDeltaMetricString, deltaMetricString)
+}
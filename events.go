@@ -0,0 +1,52 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	log "github.hpe.com/kronos/kelog"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"time"
+)
+
+const invalidSidecarConfigReason = "InvalidSidecarConfig"
+
+func newPodWarningEvent(pod *v1.Pod, reason string, message string, now time.Time) *v1.Event {
+	timestamp := metav1.NewTime(now)
+	return &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: pod.Name + ".",
+			Namespace:    pod.Namespace,
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind:            "Pod",
+			APIVersion:      "v1",
+			Namespace:       pod.Namespace,
+			Name:            pod.Name,
+			UID:             pod.UID,
+			ResourceVersion: pod.ResourceVersion,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           v1.EventTypeWarning,
+		Source:         v1.EventSource{Component: "monasca-sidecar"},
+		FirstTimestamp: timestamp,
+		LastTimestamp:  timestamp,
+		Count:          1,
+	}
+}
+
+// recordPodWarningEvent creates a warning event on the pod of the sidecar, so that the problem shows up
+// in kubectl describe pod. Errors are only logged.
+func recordPodWarningEvent(clientSet kubernetes.Interface, reason string, message string) {
+	podNamespace, podName := getPodNamespaceAndName()
+	pod, err := clientSet.CoreV1().Pods(podNamespace).Get(podName, metav1.GetOptions{})
+	if err != nil {
+		log.Errorf("Error getting pod %v in namespace %v to record event: %v", podName, podNamespace, err)
+		return
+	}
+	if _, err := clientSet.CoreV1().Events(podNamespace).Create(newPodWarningEvent(pod, reason, message, time.Now())); err != nil {
+		log.Errorf("Error recording event on pod %v in namespace %v: %v", podName, podNamespace, err)
+	}
+}
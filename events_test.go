@@ -0,0 +1,26 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+	"time"
+)
+
+func TestNewPodWarningEvent(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app-1234", Namespace: "monitoring", UID: "5678"}}
+	now := time.Unix(1520000000, 0)
+	event := newPodWarningEvent(pod, invalidSidecarConfigReason, "1 invalid sidecar rules", now)
+	assert.Equal(t, "app-1234.", event.GenerateName)
+	assert.Equal(t, "monitoring", event.Namespace)
+	assert.Equal(t, "Pod", event.InvolvedObject.Kind)
+	assert.Equal(t, "app-1234", event.InvolvedObject.Name)
+	assert.Equal(t, "5678", string(event.InvolvedObject.UID))
+	assert.Equal(t, v1.EventTypeWarning, event.Type)
+	assert.Equal(t, "InvalidSidecarConfig", event.Reason)
+	assert.Equal(t, "1 invalid sidecar rules", event.Message)
+	assert.Equal(t, now, event.FirstTimestamp.Time)
+}
@@ -0,0 +1,432 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"fmt"
+	prometheusClient "github.com/prometheus/client_model/go"
+	log "github.hpe.com/kronos/kelog"
+	"strconv"
+	"sync"
+)
+
+func init() {
+	registerRuleFunction("expr", exprFunction{})
+}
+
+type exprFunction struct{}
+
+func (exprFunction) ValidateParameters(rule SidecarRule) error {
+	if err := checkRequiredParameters(rule, "expression"); err != nil {
+		return err
+	}
+	if _, err := getExpression(rule.Parameters["expression"]); err != nil {
+		return fmt.Errorf("rule %v with function %v has invalid expression: %v", rule.Name, rule.Function, err)
+	}
+	if err := checkBoolParameters(rule, "compensateCounterReset"); err != nil {
+		return err
+	}
+	if err := checkDurationParameters(rule, "window"); err != nil {
+		return err
+	}
+	return validateVectorMatching(rule)
+}
+
+func (exprFunction) Calculate(newSnapshot prometheusSnapshot, oldSnapshot prometheusSnapshot, rule SidecarRule) []*prometheusClient.MetricFamily {
+	return calculateExpr(newSnapshot, oldSnapshot, rule)
+}
+
+func (exprFunction) CalculateWindow(snapshots []prometheusSnapshot, rule SidecarRule) []*prometheusClient.MetricFamily {
+	if len(snapshots) == 0 {
+		return []*prometheusClient.MetricFamily{}
+	}
+	return calculateExprWithContext(exprContext{newSnapshot: snapshots[len(snapshots)-1], windowSnapshots: snapshots, rule: rule})
+}
+
+type parsedExpression struct {
+	expression exprNode
+	err        error
+}
+
+var (
+	// expressions are parsed once when the rules are validated instead of every time a rule is calculated
+	parsedExpressions     = map[string]parsedExpression{}
+	parsedExpressionsLock sync.Mutex
+)
+
+// getExpression parses the expression parameter of a rule.
+func getExpression(input string) (exprNode, error) {
+	parsedExpressionsLock.Lock()
+	defer parsedExpressionsLock.Unlock()
+	parsed, ok := parsedExpressions[input]
+	if !ok {
+		parsed.expression, parsed.err = parseExpression(input)
+		parsedExpressions[input] = parsed
+	}
+	return parsed.expression, parsed.err
+}
+
+// clearExpressions forgets the parsed expressions of the rules that are no longer used after a reload.
+func clearExpressions() {
+	parsedExpressionsLock.Lock()
+	defer parsedExpressionsLock.Unlock()
+	parsedExpressions = map[string]parsedExpression{}
+}
+
+func calculateExpr(newSnapshot prometheusSnapshot, oldSnapshot prometheusSnapshot, rule SidecarRule) []*prometheusClient.MetricFamily {
+	return calculateExprWithContext(exprContext{newSnapshot: newSnapshot, oldSnapshot: oldSnapshot, rule: rule})
+}
+
+func calculateExprWithContext(context exprContext) []*prometheusClient.MetricFamily {
+	newExprMetrics := []*prometheusClient.MetricFamily{}
+	rule := context.rule
+	expression, err := getExpression(rule.Parameters["expression"])
+	if err != nil {
+		log.Errorf("Error parsing expression %v of rule %v: %v", rule.Parameters["expression"], rule.Name, err)
+		return newExprMetrics
+	}
+	result := expression.evaluate(context)
+	if result.isScalar {
+		if !result.isValid {
+			log.Infof("Expression of rule %v has no value", rule.Name)
+			return newExprMetrics
+		}
+		return append(newExprMetrics, createNewMetricFamilies(rule.Name, nil, result.scalar))
+	}
+	for _, sample := range result.vector {
+		// store expression metric into a new metric family
+		newExprMetrics = append(newExprMetrics, createNewMetricFamilies(rule.Name, sample.labels, sample.value))
+	}
+	log.Debugf("Successfully calculated expr for rule %v", rule.Name)
+	log.Debugf("Expr metrics = %v", convertMetricFamiliesIntoTextString(newExprMetrics))
+	return newExprMetrics
+}
+
+// exprContext holds either the old snapshot, or every snapshot within the rule window when the rule has a window.
+type exprContext struct {
+	newSnapshot     prometheusSnapshot
+	oldSnapshot     prometheusSnapshot
+	windowSnapshots []prometheusSnapshot
+	rule            SidecarRule
+}
+
+// exprValue is either a scalar or a vector of series. A scalar without value comes from a division by zero.
+type exprValue struct {
+	isScalar bool
+	isValid  bool
+	scalar   float64
+	vector   []vectorSample
+}
+
+type exprNode interface {
+	evaluate(context exprContext) exprValue
+}
+
+type numberNode struct {
+	value float64
+}
+
+type metricNode struct {
+	metricName string
+}
+
+type callNode struct {
+	functionName string
+	metricName   string
+}
+
+type unaryNode struct {
+	operand exprNode
+}
+
+type binaryNode struct {
+	op    byte
+	left  exprNode
+	right exprNode
+}
+
+func (n numberNode) evaluate(context exprContext) exprValue {
+	return exprValue{isScalar: true, isValid: true, scalar: n.value}
+}
+
+func (n metricNode) evaluate(context exprContext) exprValue {
+	return exprValue{vector: getVectorSamples(context.newSnapshot.metrics, n.metricName)}
+}
+
+func (n callNode) evaluate(context exprContext) exprValue {
+	samples := []vectorSample{}
+	if len(context.windowSnapshots) > 0 {
+		// sum the increases between every two snapshots within the window
+		for _, windowIncrease := range getWindowIncreases(context.windowSnapshots, n.metricName, context.rule) {
+			increase := windowIncrease.increase
+			if n.functionName == "rate" {
+				if windowIncrease.elapsedSeconds <= 0 {
+					continue
+				}
+				increase = increase / windowIncrease.elapsedSeconds
+			}
+			samples = append(samples, vectorSample{labels: windowIncrease.labels, value: increase})
+		}
+		return exprValue{vector: samples}
+	}
+	queryInterval := getQueryInterval(context.newSnapshot, context.oldSnapshot)
+	for _, pm := range selectMetricFamilies(context.newSnapshot.metrics, n.metricName) {
+		for _, newM := range pm.Metric {
+			oldM, succeedOld := context.oldSnapshot.index.findMetric(*pm.Name, *pm.Type, newM.Label)
+			if !succeedOld {
+				continue
+			}
+			oldValueFloat, succeedOldValue := getValueBasedOnType(*pm.Type, *oldM)
+			newValueFloat, succeedNew := getValueBasedOnType(*pm.Type, *newM)
+			if !succeedOldValue || !succeedNew {
+				log.Warnf("Error getting values from prometheus metric: %v", *pm.Name)
+				continue
+			}
+			increase, succeedIncrease := getIncrease(*pm.Type, newValueFloat, oldValueFloat, context.rule)
+			if !succeedIncrease {
+				log.Warnf("Counter %v has been reset", *pm.Name)
+				continue
+			}
+			if n.functionName == "rate" {
+				increase = increase / getElapsedSeconds(newM, oldM, queryInterval)
+			}
+			samples = append(samples, vectorSample{labels: newM.Label, value: increase})
+		}
+	}
+	return exprValue{vector: samples}
+}
+
+func (n unaryNode) evaluate(context exprContext) exprValue {
+	return applyExprOperator('*', exprValue{isScalar: true, isValid: true, scalar: -1}, n.operand.evaluate(context), context.rule)
+}
+
+func (n binaryNode) evaluate(context exprContext) exprValue {
+	return applyExprOperator(n.op, n.left.evaluate(context), n.right.evaluate(context), context.rule)
+}
+
+func applyExprOperator(op byte, left exprValue, right exprValue, rule SidecarRule) exprValue {
+	if left.isScalar && right.isScalar {
+		value, ok := applyArithmetic(op, left.scalar, right.scalar)
+		return exprValue{isScalar: true, isValid: ok && left.isValid && right.isValid, scalar: value}
+	}
+	samples := []vectorSample{}
+	switch {
+	case left.isScalar:
+		for _, sample := range right.vector {
+			if value, ok := applyArithmetic(op, left.scalar, sample.value); ok && left.isValid {
+				samples = append(samples, vectorSample{labels: sample.labels, value: value})
+			}
+		}
+	case right.isScalar:
+		for _, sample := range left.vector {
+			if value, ok := applyArithmetic(op, sample.value, right.scalar); ok && right.isValid {
+				samples = append(samples, vectorSample{labels: sample.labels, value: value})
+			}
+		}
+	default:
+		// match series the same way as ratio
+		matches := matchVectorsByLabels(left.vector, right.vector)
+		if hasVectorMatching(rule) {
+			matches = matchVectors(left.vector, right.vector, rule)
+		}
+		for _, match := range matches {
+			if value, ok := applyArithmetic(op, match.numerator, match.denominator); ok {
+				samples = append(samples, vectorSample{labels: match.labels, value: value})
+			}
+		}
+	}
+	return exprValue{vector: samples}
+}
+
+func applyArithmetic(op byte, left float64, right float64) (float64, bool) {
+	switch op {
+	case '+':
+		return left + right, true
+	case '-':
+		return left - right, true
+	case '*':
+		return left * right, true
+	case '/':
+		// drop the series like ratio does with a zero denominator
+		if right == 0.0 {
+			return 0.0, false
+		}
+		return left / right, true
+	}
+	return 0.0, false
+}
+
+// exprParser is a recursive descent parser for:
+//
+//	expression = term { ("+" | "-") term }
+//	term       = unary { ("*" | "/") unary }
+//	unary      = "-" unary | primary
+//	primary    = number | metricName | ("rate" | "delta") "(" metricName ")" | "(" expression ")"
+type exprParser struct {
+	input    string
+	position int
+}
+
+func parseExpression(input string) (exprNode, error) {
+	parser := &exprParser{input: input}
+	node, err := parser.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	parser.skipSpaces()
+	if parser.position < len(parser.input) {
+		return nil, fmt.Errorf("unexpected %q at position %v", parser.input[parser.position:], parser.position)
+	}
+	return node, nil
+}
+
+func (p *exprParser) skipSpaces() {
+	for p.position < len(p.input) && (p.input[p.position] == ' ' || p.input[p.position] == '\t' || p.input[p.position] == '\n') {
+		p.position++
+	}
+}
+
+// peek returns the next character after spaces, or 0 at the end of the input.
+func (p *exprParser) peek() byte {
+	p.skipSpaces()
+	if p.position >= len(p.input) {
+		return 0
+	}
+	return p.input[p.position]
+}
+
+func (p *exprParser) expect(c byte) error {
+	if p.peek() != c {
+		return fmt.Errorf("expected %q at position %v", c, p.position)
+	}
+	p.position++
+	return nil
+}
+
+func (p *exprParser) parseExpression() (exprNode, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == '+' || p.peek() == '-' {
+		op := p.input[p.position]
+		p.position++
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseTerm() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == '*' || p.peek() == '/' {
+		op := p.input[p.position]
+		p.position++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.peek() == '-' {
+		p.position++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return unaryNode{operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.position++
+		node, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(')'); err != nil {
+			return nil, err
+		}
+		return node, nil
+	case (c >= '0' && c <= '9') || c == '.':
+		return p.parseNumber()
+	case isMetricNameChar(c, 0):
+		name := p.parseMetricName()
+		if p.peek() != '(' {
+			return metricNode{metricName: name}, nil
+		}
+		if name != "rate" && name != "delta" {
+			return nil, fmt.Errorf("unknown function %v", name)
+		}
+		p.position++
+		if !isMetricNameChar(p.peek(), 0) {
+			return nil, fmt.Errorf("expected metric name at position %v", p.position)
+		}
+		metricName := p.parseMetricName()
+		if err := p.expect(')'); err != nil {
+			return nil, err
+		}
+		return callNode{functionName: name, metricName: metricName}, nil
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at position %v", c, p.position)
+}
+
+func (p *exprParser) parseNumber() (exprNode, error) {
+	start := p.position
+	for p.position < len(p.input) {
+		c := p.input[p.position]
+		isExponentSign := (c == '+' || c == '-') && p.position > start && (p.input[p.position-1] == 'e' || p.input[p.position-1] == 'E')
+		if !((c >= '0' && c <= '9') || c == '.' || c == 'e' || c == 'E' || isExponentSign) {
+			break
+		}
+		p.position++
+	}
+	value, err := strconv.ParseFloat(p.input[start:p.position], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid number %v", p.input[start:p.position])
+	}
+	return numberNode{value: value}, nil
+}
+
+func (p *exprParser) parseMetricName() string {
+	start := p.position
+	for p.position < len(p.input) && isMetricNameChar(p.input[p.position], p.position-start) {
+		p.position++
+	}
+	return p.input[start:p.position]
+}
+
+func isMetricNameChar(c byte, position int) bool {
+	return c == ':' || isLabelNameChar(c, position)
+}
+
+// getExpressionMetricNames returns every metric name the expression reads.
+func getExpressionMetricNames(node exprNode) []string {
+	switch n := node.(type) {
+	case metricNode:
+		return []string{n.metricName}
+	case callNode:
+		return []string{n.metricName}
+	case unaryNode:
+		return getExpressionMetricNames(n.operand)
+	case binaryNode:
+		return append(getExpressionMetricNames(n.left), getExpressionMetricNames(n.right)...)
+	}
+	return []string{}
+}
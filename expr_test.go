@@ -0,0 +1,153 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCalculateExpr(t *testing.T) {
+	prometheusMetricsString := `
+# HELP errors_total Counts request errors by path
+# TYPE errors_total counter
+errors_total{path="/rest/metrics"} 30
+errors_total{path="/rest/support"} 12
+# HELP retries_total Counts retried requests by path
+# TYPE retries_total counter
+retries_total{path="/rest/metrics"} 10
+retries_total{path="/rest/support"} 2
+# HELP requests_total Counts requests by path
+# TYPE requests_total counter
+requests_total{path="/rest/metrics"} 400
+requests_total{path="/rest/support"} 0
+`
+	metricFamilies, err := parsePrometheusMetricsToMetricFamilies(prometheusMetricsString)
+	assert.NoError(t, err)
+	exprRuleParam := map[string]string{}
+	exprRuleParam["expression"] = "(errors_total - retries_total) / requests_total * 100"
+	exprRule := SidecarRule{Name: "exprRuleTestName", Function: "expr", Parameters: exprRuleParam}
+
+	// (30 - 10) / 400 * 100 = 5
+	// requests_total of /rest/support is zero
+	exprMetricString := convertMetricFamiliesIntoTextString(calculateExpr(newTestSnapshot(metricFamilies, 30), newTestSnapshot(metricFamilies, 0), exprRule))
+	expectedExprMetricString := `# HELP exprRuleTestName exprRuleTestName
+# TYPE exprRuleTestName gauge
+exprRuleTestName{path="/rest/metrics"} 5
+`
+	assert.Equal(t, expectedExprMetricString, exprMetricString)
+}
+
+func TestCalculateExprWithRateAndDelta(t *testing.T) {
+	oldPrometheusMetricsString := `
+# HELP request_count Counts requests by method and path
+# TYPE request_count counter
+request_count{method="GET",path="/rest/metrics"} 25
+# HELP request_total_time Total time in second requests take by method and path
+# TYPE request_total_time counter
+request_total_time{method="GET",path="/rest/metrics"} 0.5
+`
+	newPrometheusMetricsString := `
+# HELP request_count Counts requests by method and path
+# TYPE request_count counter
+request_count{method="GET",path="/rest/metrics"} 85
+# HELP request_total_time Total time in second requests take by method and path
+# TYPE request_total_time counter
+request_total_time{method="GET",path="/rest/metrics"} 3.5
+`
+	oldMetricFamilies, errOldMF := parsePrometheusMetricsToMetricFamilies(oldPrometheusMetricsString)
+	newMetricFamilies, errNewMF := parsePrometheusMetricsToMetricFamilies(newPrometheusMetricsString)
+	assert.NoError(t, errOldMF)
+	assert.NoError(t, errNewMF)
+	exprRuleParam := map[string]string{}
+	exprRuleParam["expression"] = "-delta(request_total_time) / rate(request_count)"
+	exprRule := SidecarRule{Name: "exprRuleTestName", Function: "expr", Parameters: exprRuleParam}
+
+	// -(3.5 - 0.5) / ((85 - 25) / 30) = -1.5
+	exprMetricString := convertMetricFamiliesIntoTextString(calculateExpr(newTestSnapshot(newMetricFamilies, 30), newTestSnapshot(oldMetricFamilies, 0), exprRule))
+	expectedExprMetricString := `# HELP exprRuleTestName exprRuleTestName
+# TYPE exprRuleTestName gauge
+exprRuleTestName{method="GET",path="/rest/metrics"} -1.5
+`
+	assert.Equal(t, expectedExprMetricString, exprMetricString)
+}
+
+func TestParseExpression(t *testing.T) {
+	for _, expression := range []string{"a + b * 2", "(a - b) / c", "-1.5e-3 * rate(http_requests_total)", "node:cpu:ratio * 100"} {
+		_, err := parseExpression(expression)
+		assert.NoError(t, err, expression)
+	}
+	for _, expression := range []string{"", "a +", "(a - b", "a b", "sum(a)", "rate(1)", "a{code=\"500\"}"} {
+		_, err := parseExpression(expression)
+		assert.Error(t, err, expression)
+	}
+}
+
+func TestValidateExprParameters(t *testing.T) {
+	exprRule := SidecarRule{Name: "exprRuleTestName", Function: "expr", Parameters: map[string]string{"expression": "a / "}}
+	assert.Error(t, exprFunction{}.ValidateParameters(exprRule))
+	exprRule.Parameters["expression"] = "a / b"
+	assert.NoError(t, exprFunction{}.ValidateParameters(exprRule))
+}
+
+func TestCalculateExprMatchesDenominatorWithoutGe(t *testing.T) {
+	metricFamilies, err := parsePrometheusMetricsToMetricFamilies(`
+# HELP request_bucket_count Counts requests slower than ge seconds by method
+# TYPE request_bucket_count gauge
+request_bucket_count{ge="1",method="GET"} 2
+request_bucket_count{ge="2.5",method="GET"} 1
+request_bucket_count{ge="1",method="POST"} 3
+# HELP request_count Counts requests by method
+# TYPE request_count gauge
+request_count{method="GET"} 10
+`)
+	assert.NoError(t, err)
+	exprRule := SidecarRule{Name: "exprRuleTestName", Function: "expr", Parameters: map[string]string{"expression": "request_bucket_count / request_count"}}
+
+	// like ratio, every ge bucket is divided by the series without ge, POST has no denominator
+	exprMetricString := convertMetricFamiliesIntoTextString(calculateExpr(newTestSnapshot(metricFamilies, 30), newTestSnapshot(metricFamilies, 0), exprRule))
+	expectedExprMetricString := `# HELP exprRuleTestName exprRuleTestName
+# TYPE exprRuleTestName gauge
+exprRuleTestName{ge="1",method="GET"} 0.2
+# HELP exprRuleTestName exprRuleTestName
+# TYPE exprRuleTestName gauge
+exprRuleTestName{ge="2.5",method="GET"} 0.1
+`
+	assert.Equal(t, expectedExprMetricString, exprMetricString)
+	ratioRule := SidecarRule{Name: "exprRuleTestName", Function: "ratio", Parameters: map[string]string{"numerator": "request_bucket_count", "denominator": "request_count"}}
+	assert.Equal(t, expectedExprMetricString, convertMetricFamiliesIntoTextString(calculateRatio(newTestSnapshot(metricFamilies, 0), ratioRule)))
+}
+
+func TestCalculateExprWithWindow(t *testing.T) {
+	snapshots := []prometheusSnapshot{}
+	for i, value := range []string{"10", "40", "100"} {
+		metricFamilies, err := parsePrometheusMetricsToMetricFamilies(`
+# TYPE request_count counter
+request_count{method="GET"} ` + value + "\n")
+		assert.NoError(t, err)
+		snapshots = append(snapshots, newTestSnapshot(metricFamilies, float64(30*i)))
+	}
+	exprRule := SidecarRule{Name: "exprRuleTestName", Function: "expr", Parameters: map[string]string{"expression": "rate(request_count) * 60 + delta(request_count)", "window": "1m"}}
+
+	// (100 - 10) / 60 * 60 + (100 - 10) = 180
+	exprMetricString := convertMetricFamiliesIntoTextString(exprFunction{}.CalculateWindow(snapshots, exprRule))
+	expectedExprMetricString := `# HELP exprRuleTestName exprRuleTestName
+# TYPE exprRuleTestName gauge
+exprRuleTestName{method="GET"} 180
+`
+	assert.Equal(t, expectedExprMetricString, exprMetricString)
+}
+
+func TestGetExpression(t *testing.T) {
+	defer clearExpressions()
+	expression, err := getExpression("a / b")
+	assert.NoError(t, err)
+	// parsed once and reused
+	cachedExpression, err := getExpression("a / b")
+	assert.NoError(t, err)
+	assert.Equal(t, expression, cachedExpression)
+	assert.Contains(t, parsedExpressions, "a / b")
+
+	clearExpressions()
+	assert.Empty(t, parsedExpressions)
+}
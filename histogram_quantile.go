@@ -0,0 +1,173 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"fmt"
+	prometheusClient "github.com/prometheus/client_model/go"
+	log "github.hpe.com/kronos/kelog"
+	"math"
+	"sort"
+	"strconv"
+)
+
+func init() {
+	registerRuleFunction("histogramQuantile", histogramQuantileFunction{})
+}
+
+type histogramQuantileFunction struct{}
+
+func (histogramQuantileFunction) ValidateParameters(rule SidecarRule) error {
+	if err := checkRequiredParameters(rule, "name", "quantile"); err != nil {
+		return err
+	}
+	if _, err := strconv.ParseFloat(rule.Parameters["quantile"], 64); err != nil {
+		return fmt.Errorf("rule %v with function %v has invalid quantile %v", rule.Name, rule.Function, rule.Parameters["quantile"])
+	}
+	if err := checkBoolParameters(rule, "compensateCounterReset"); err != nil {
+		return err
+	}
+	return checkDurationParameters(rule, "window")
+}
+
+func (histogramQuantileFunction) Calculate(newSnapshot prometheusSnapshot, oldSnapshot prometheusSnapshot, rule SidecarRule) []*prometheusClient.MetricFamily {
+	return calculateHistogramQuantile(newSnapshot, oldSnapshot, rule)
+}
+
+type histogramBucket struct {
+	upperBound float64
+	count      float64
+}
+
+type histogramSeries struct {
+	labels  []*prometheusClient.LabelPair
+	buckets []histogramBucket
+	reset   bool
+}
+
+func calculateHistogramQuantile(newSnapshot prometheusSnapshot, oldSnapshot prometheusSnapshot, rule SidecarRule) []*prometheusClient.MetricFamily {
+	// histogramQuantile = histogram_quantile(quantile, newBucket - oldBucket) for each label set
+	newHistogramQuantileMetrics := []*prometheusClient.MetricFamily{}
+	quantile, errParseFloat := strconv.ParseFloat(rule.Parameters["quantile"], 64)
+	if errParseFloat != nil {
+		log.Errorf("Error converting quantile %v of rule %v", rule.Parameters["quantile"], rule.Name)
+		return newHistogramQuantileMetrics
+	}
+
+	// group bucket deltas by labels without le
+	seriesKeys := []string{}
+	seriesMap := map[string]*histogramSeries{}
+	for _, pm := range selectMetricFamiliesWithSuffix(newSnapshot.metrics, rule.Parameters["name"], "_bucket") {
+		for _, newM := range pm.Metric {
+			oldValueFloat, succeedOld := oldSnapshot.index.findValue(*pm.Name, *pm.Type, newM.Label)
+			if !succeedOld {
+				continue
+			}
+			newValueFloat, succeedNew := getValueBasedOnType(*pm.Type, *newM)
+			if !succeedNew {
+				log.Warnf("Error getting values from new prometheus metric: %v", *pm.Name)
+				continue
+			}
+			upperBound, succeedUpperBound := getBucketUpperBound(newM.Label)
+			if !succeedUpperBound {
+				log.Warnf("Error getting le label from prometheus metric: %v", *pm.Name)
+				continue
+			}
+			labelsWithoutLe := removeLabel(newM.Label, "le")
+			seriesKey := convertLabelsIntoKey(labelsWithoutLe)
+			series, ok := seriesMap[seriesKey]
+			if !ok {
+				series = &histogramSeries{labels: labelsWithoutLe}
+				seriesMap[seriesKey] = series
+				seriesKeys = append(seriesKeys, seriesKey)
+			}
+			// buckets are cumulative counters converted to gauges
+			bucketIncrease, succeedIncrease := getIncrease(prometheusClient.MetricType_COUNTER, newValueFloat, oldValueFloat, rule)
+			if !succeedIncrease {
+				series.reset = true
+			}
+			series.buckets = append(series.buckets, histogramBucket{upperBound: upperBound, count: bucketIncrease})
+		}
+	}
+
+	for _, seriesKey := range seriesKeys {
+		series := seriesMap[seriesKey]
+		if series.reset {
+			log.Warnf("Histogram %v has been reset", rule.Parameters["name"])
+			continue
+		}
+		quantileValue, succeedQuantile := bucketQuantile(quantile, series.buckets)
+		if !succeedQuantile {
+			log.Infof("No observations in histogram %v with labels %v", rule.Parameters["name"], series.labels)
+			continue
+		}
+		// store quantile metric into a new metric family
+		newHistogramQuantileMetrics = append(newHistogramQuantileMetrics, createNewMetricFamilies(rule.Name, series.labels, quantileValue))
+	}
+	log.Debugf("Successfully calculated histogramQuantile for rule %v", rule.Name)
+	log.Debugf("Histogram quantile metrics = %v", convertMetricFamiliesIntoTextString(newHistogramQuantileMetrics))
+	return newHistogramQuantileMetrics
+}
+
+// bucketQuantile interpolates the quantile linearly within the bucket it falls into,
+// following the same rules as histogram_quantile in PromQL.
+func bucketQuantile(quantile float64, buckets []histogramBucket) (float64, bool) {
+	if quantile < 0 {
+		return math.Inf(-1), true
+	}
+	if quantile > 1 {
+		return math.Inf(+1), true
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].upperBound < buckets[j].upperBound })
+	if len(buckets) < 2 || !math.IsInf(buckets[len(buckets)-1].upperBound, +1) {
+		return 0.0, false
+	}
+	// cumulative counts scraped at slightly different times may not be monotonic
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i].count < buckets[i-1].count {
+			buckets[i].count = buckets[i-1].count
+		}
+	}
+	observations := buckets[len(buckets)-1].count
+	if observations == 0 {
+		return 0.0, false
+	}
+	rank := quantile * observations
+	b := sort.Search(len(buckets)-1, func(i int) bool { return buckets[i].count >= rank })
+
+	if b == len(buckets)-1 {
+		return buckets[len(buckets)-2].upperBound, true
+	}
+	if b == 0 && buckets[0].upperBound <= 0 {
+		return buckets[0].upperBound, true
+	}
+	bucketStart := 0.0
+	bucketEnd := buckets[b].upperBound
+	count := buckets[b].count
+	if b > 0 {
+		bucketStart = buckets[b-1].upperBound
+		count -= buckets[b-1].count
+		rank -= buckets[b-1].count
+	}
+	return bucketStart + (bucketEnd-bucketStart)*(rank/count), true
+}
+
+func getBucketUpperBound(labels []*prometheusClient.LabelPair) (float64, bool) {
+	for _, label := range labels {
+		if *label.Name == "le" {
+			upperBound, err := strconv.ParseFloat(*label.Value, 64)
+			return upperBound, err == nil
+		}
+	}
+	return 0.0, false
+}
+
+func removeLabel(labels []*prometheusClient.LabelPair, labelName string) []*prometheusClient.LabelPair {
+	newLabels := []*prometheusClient.LabelPair{}
+	for _, label := range labels {
+		if *label.Name != labelName {
+			newLabels = append(newLabels, label)
+		}
+	}
+	return newLabels
+}
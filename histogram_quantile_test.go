@@ -0,0 +1,139 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestCalculateHistogramQuantile(t *testing.T) {
+	oldPrometheusMetricsString := `
+# HELP http_request_duration_seconds A histogram of the request duration.
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{method="GET",le="0.1"} 10
+http_request_duration_seconds_bucket{method="GET",le="0.5"} 20
+http_request_duration_seconds_bucket{method="GET",le="1"} 25
+http_request_duration_seconds_bucket{method="GET",le="+Inf"} 30
+http_request_duration_seconds_sum{method="GET"} 12
+http_request_duration_seconds_count{method="GET"} 30
+http_request_duration_seconds_bucket{method="POST",le="0.1"} 0
+http_request_duration_seconds_bucket{method="POST",le="0.5"} 0
+http_request_duration_seconds_bucket{method="POST",le="1"} 0
+http_request_duration_seconds_bucket{method="POST",le="+Inf"} 0
+http_request_duration_seconds_sum{method="POST"} 0
+http_request_duration_seconds_count{method="POST"} 0
+`
+	newPrometheusMetricsString := `
+# HELP http_request_duration_seconds A histogram of the request duration.
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{method="GET",le="0.1"} 30
+http_request_duration_seconds_bucket{method="GET",le="0.5"} 60
+http_request_duration_seconds_bucket{method="GET",le="1"} 75
+http_request_duration_seconds_bucket{method="GET",le="+Inf"} 80
+http_request_duration_seconds_sum{method="GET"} 40
+http_request_duration_seconds_count{method="GET"} 80
+http_request_duration_seconds_bucket{method="POST",le="0.1"} 0
+http_request_duration_seconds_bucket{method="POST",le="0.5"} 10
+http_request_duration_seconds_bucket{method="POST",le="1"} 10
+http_request_duration_seconds_bucket{method="POST",le="+Inf"} 20
+http_request_duration_seconds_sum{method="POST"} 30
+http_request_duration_seconds_count{method="POST"} 20
+`
+	oldMetricFamilies, errOldMF := parsePrometheusMetricsToMetricFamilies(oldPrometheusMetricsString)
+	newMetricFamilies, errNewMF := parsePrometheusMetricsToMetricFamilies(newPrometheusMetricsString)
+	assert.NoError(t, errOldMF)
+	assert.NoError(t, errNewMF)
+	newPrometheusMetricsWithNoHistogramSummary := replaceHistogramSummaryToGauge(newMetricFamilies)
+	oldPrometheusMetricsWithNoHistogramSummary := replaceHistogramSummaryToGauge(oldMetricFamilies)
+
+	histogramQuantileRuleParam := map[string]string{}
+	histogramQuantileRuleParam["name"] = "http_request_duration_seconds"
+	histogramQuantileRuleParam["quantile"] = "0.5"
+	histogramQuantileRule := SidecarRule{Name: "histogramQuantileRuleTestName", Function: "histogramQuantile", Parameters: histogramQuantileRuleParam}
+
+	// GET bucket deltas: 20, 40, 50, 50 -> rank 25 in (0.1, 0.5]: 0.1 + 0.4 * 5 / 20 = 0.2
+	// POST bucket deltas: 0, 10, 10, 20 -> rank 10 in (0.1, 0.5]: 0.1 + 0.4 * 10 / 10 = 0.5
+	histogramQuantileMetricFamilies := calculateHistogramQuantile(newTestSnapshot(newPrometheusMetricsWithNoHistogramSummary, 30), newTestSnapshot(oldPrometheusMetricsWithNoHistogramSummary, 0), histogramQuantileRule)
+	histogramQuantileMetricString := convertMetricFamiliesIntoTextString(histogramQuantileMetricFamilies)
+	expectedHistogramQuantileMetricString := `# HELP histogramQuantileRuleTestName histogramQuantileRuleTestName
+# TYPE histogramQuantileRuleTestName gauge
+histogramQuantileRuleTestName{method="GET"} 0.2
+# HELP histogramQuantileRuleTestName histogramQuantileRuleTestName
+# TYPE histogramQuantileRuleTestName gauge
+histogramQuantileRuleTestName{method="POST"} 0.5
+`
+	assert.Equal(t, expectedHistogramQuantileMetricString, histogramQuantileMetricString)
+
+	// GET rank 45 in (0.5, 1]: 0.5 + 0.5 * 5 / 10 = 0.75
+	// POST rank 18 falls into +Inf bucket, use the highest finite upper bound: 1
+	histogramQuantileRuleParam["quantile"] = "0.9"
+	histogramQuantileMetricFamilies = calculateHistogramQuantile(newTestSnapshot(newPrometheusMetricsWithNoHistogramSummary, 30), newTestSnapshot(oldPrometheusMetricsWithNoHistogramSummary, 0), histogramQuantileRule)
+	histogramQuantileMetricString = convertMetricFamiliesIntoTextString(histogramQuantileMetricFamilies)
+	expectedHistogramQuantileMetricString = `# HELP histogramQuantileRuleTestName histogramQuantileRuleTestName
+# TYPE histogramQuantileRuleTestName gauge
+histogramQuantileRuleTestName{method="GET"} 0.75
+# HELP histogramQuantileRuleTestName histogramQuantileRuleTestName
+# TYPE histogramQuantileRuleTestName gauge
+histogramQuantileRuleTestName{method="POST"} 1
+`
+	assert.Equal(t, expectedHistogramQuantileMetricString, histogramQuantileMetricString)
+}
+
+func TestCalculateHistogramQuantileWithNoObservations(t *testing.T) {
+	prometheusMetricsString := `
+# HELP http_request_duration_seconds A histogram of the request duration.
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{le="0.1"} 10
+http_request_duration_seconds_bucket{le="+Inf"} 30
+http_request_duration_seconds_sum 12
+http_request_duration_seconds_count 30
+`
+	metricFamilies, err := parsePrometheusMetricsToMetricFamilies(prometheusMetricsString)
+	assert.NoError(t, err)
+	prometheusMetricsWithNoHistogramSummary := replaceHistogramSummaryToGauge(metricFamilies)
+
+	histogramQuantileRuleParam := map[string]string{}
+	histogramQuantileRuleParam["name"] = "http_request_duration_seconds"
+	histogramQuantileRuleParam["quantile"] = "0.99"
+	histogramQuantileRule := SidecarRule{Name: "histogramQuantileRuleTestName", Function: "histogramQuantile", Parameters: histogramQuantileRuleParam}
+
+	histogramQuantileMetricFamilies := calculateHistogramQuantile(newTestSnapshot(prometheusMetricsWithNoHistogramSummary, 30), newTestSnapshot(prometheusMetricsWithNoHistogramSummary, 0), histogramQuantileRule)
+	assert.Equal(t, 0, len(histogramQuantileMetricFamilies))
+}
+
+func TestBucketQuantile(t *testing.T) {
+	buckets := []histogramBucket{
+		{upperBound: math.Inf(+1), count: 100},
+		{upperBound: 1, count: 100},
+		{upperBound: 0.5, count: 50},
+	}
+	// buckets are sorted by upper bound before interpolation
+	quantile, ok := bucketQuantile(0.25, buckets)
+	assert.True(t, ok)
+	assert.Equal(t, 0.25, quantile)
+
+	quantile, ok = bucketQuantile(-1, buckets)
+	assert.True(t, ok)
+	assert.True(t, math.IsInf(quantile, -1))
+
+	quantile, ok = bucketQuantile(2, buckets)
+	assert.True(t, ok)
+	assert.True(t, math.IsInf(quantile, +1))
+
+	// missing +Inf bucket
+	_, ok = bucketQuantile(0.5, []histogramBucket{{upperBound: 0.5, count: 1}, {upperBound: 1, count: 2}})
+	assert.False(t, ok)
+}
+
+func TestValidateHistogramQuantileParameters(t *testing.T) {
+	histogramQuantileRule := SidecarRule{Name: "histogramQuantileRuleTestName", Function: "histogramQuantile", Parameters: map[string]string{"name": "request_duration_seconds", "quantile": "0.9"}}
+	assert.NoError(t, histogramQuantileFunction{}.ValidateParameters(histogramQuantileRule))
+	histogramQuantileRule.Parameters["window"] = "5m"
+	assert.NoError(t, histogramQuantileFunction{}.ValidateParameters(histogramQuantileRule))
+	for _, window := range []string{"5", "0s", "-1m"} {
+		histogramQuantileRule.Parameters["window"] = window
+		assert.Error(t, histogramQuantileFunction{}.ValidateParameters(histogramQuantileRule), window)
+	}
+}
@@ -3,84 +3,208 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"github.com/golang/protobuf/proto"
 	prometheusClient "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	log "github.hpe.com/kronos/kelog"
+	"io"
 	"io/ioutil"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"math"
+	"mime"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
 func main() {
 	// set log level
 	setLogLevel()
-	// retry to get annotations
-	annotations := retryGetAnnotations()
-	// get Prometheus url
-	prometheusUrl, succeedFlag := getPrometheusUrl(annotations)
+	// check rules offline without scraping or serving metrics
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		if err := runCheck(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	// get annotations from the config file in standalone mode, otherwise from the pod
+	configFile, errConfig := getConfigFile(os.Args[1:])
+	if errConfig != nil {
+		log.Fatalf("Error parsing command line: %v", errConfig)
+	}
+	annotations := map[string]string{}
+	// invalid rules are only logged in standalone mode
+	reportInvalidConfig := func(err error) {}
+	if configFile != "" {
+		log.Infof("Sidecar runs standalone with config file %v", configFile)
+		annotations, errConfig = loadAnnotationsFromFile(configFile)
+		if errConfig != nil {
+			log.Fatalf("Error loading config file: %v", errConfig)
+		}
+	} else {
+		// retry to get annotations
+		annotations = retryGetAnnotations()
+		// merge the rules shared in a ConfigMap
+		podNamespace, _ := getPodNamespaceAndName()
+		clientSet := newKubernetesClientSet()
+		annotations, errConfig = resolveRulesConfigMap(annotations, clientSet.CoreV1().ConfigMaps(podNamespace))
+		if errConfig != nil {
+			log.Fatalf("Error getting sidecar rules: %v", errConfig)
+		}
+		// report invalid rules as an event on the pod, once until the problems change
+		lastReportedError := ""
+		reportInvalidConfig = func(err error) {
+			if err.Error() != lastReportedError {
+				lastReportedError = err.Error()
+				recordPodWarningEvent(clientSet, invalidSidecarConfigReason, err.Error())
+			}
+		}
+	}
+	// get prometheus url, rules, query interval and listen settings from annotations
+	config, errParse := parseSidecarConfig(annotations)
+	if errParse != nil {
+		reportInvalidConfig(errParse)
+		log.Fatalf("Error getting sidecar config: %v", errParse)
+	}
+	log.Infof("Sidecar gets prometheus metrics from URL = %v", config.prometheusUrl)
+	log.Infof("Sidecar pushes new prometheus metric to %v", config.listenPort+config.listenPath)
 
-	if !succeedFlag {
-		log.Fatalf("Errror getting prometheus URL.")
+	// watch annotations to reload the config without restarting
+	reloads := make(chan map[string]string, 1)
+	if configFile != "" {
+		go watchConfigFile(configFile, configFilePollInterval, reloads, nil)
+	} else {
+		go watchPodAnnotations(reloads)
 	}
-	// get rules from annotations
-	sidecarRulesString, queryInterval, listenPort, listenPath := getSidecarRulesFromAnnotations(annotations)
-	log.Infof("Sidecar gets prometheus metrics from URL = %v", prometheusUrl)
-	log.Infof("Sidecar pushes new prometheus metric to %v", listenPort+listenPath)
 
-	sidecarRules := parseYamlSidecarRules(sidecarRulesString)
+	// shut down gracefully when the pod is stopped, cancelling scrapes, pushes and their retries
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-stop
+		log.Infof("Sidecar is shutting down")
+		cancel()
+	}()
+
 	// get prometheus url and prometheus metric response body
-	oldPrometheusMetrics := getPrometheusMetrics(prometheusUrl)
-	oldPrometheusMetricString := convertMetricFamiliesIntoTextString(oldPrometheusMetrics)
+	oldPrometheusMetrics, errScrape := getPrometheusMetrics(ctx, config.prometheusUrl)
+	recordScrapeResult(errScrape)
+	// keep old snapshots in memory to calculate over the longest rule window
+	oldSnapshots := newSnapshotBuffer(getSnapshotBufferCapacity(config.sidecarRules, config.queryInterval))
+	if errScrape != nil {
+		log.Errorf("Error getting prometheus metrics: %v", errScrape)
+	} else {
+		oldSnapshots.add(newPrometheusSnapshot(replaceHistogramSummaryToGauge(oldPrometheusMetrics), time.Now()))
+	}
+	sidecarExposition := newExposition(append(oldPrometheusMetrics[:len(oldPrometheusMetrics):len(oldPrometheusMetrics)], gatherSidecarMetrics()...))
 
 	// start web server
-	http.HandleFunc(listenPath, func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, oldPrometheusMetricString) // send data to client side
-	})
-	go http.ListenAndServe(":"+listenPort, nil) // set listen port
+	metricsHandler := newMetricsHandler(sidecarExposition.get)
+	server, errListen := startMetricsServer(config.listenPort, config.listenPath, metricsHandler)
+	if errListen != nil {
+		log.Fatalf("Error listening on port %v: %v", config.listenPort, errListen)
+	}
+	// push calculated metrics to monasca for pods without a local agent
+	monasca := newMonascaForwarderForConfig(config)
+	if monasca != nil {
+		log.Infof("Sidecar pushes calculated metrics to monasca %v", config.monascaUrl)
+	}
+	monascaPusher := newMonascaPusher(ctx, monasca)
+	// push to a remote_write endpoint such as Cortex or Thanos
+	remoteWriter := newRemoteWriterForConfig(config)
+	if remoteWriter != nil {
+		log.Infof("Sidecar pushes calculated metrics to remote write endpoint %v", config.remoteWriteUrl)
+	}
+	remoteWritePusher := newRemoteWritePusher(ctx, remoteWriter)
 
 	// Infinite for loop to scrape prometheus metrics and calculate rate every 30 seconds
 	for {
-		newRateMetrics := []*prometheusClient.MetricFamily{}
-		newAvgMetrics := []*prometheusClient.MetricFamily{}
-		newRatioMetrics := []*prometheusClient.MetricFamily{}
-		newDeltaRatioMetrics := []*prometheusClient.MetricFamily{}
-		newDeltaMetrics := []*prometheusClient.MetricFamily{}
-
 		// sleep for 30 seconds or how long queryInterval is
-		time.Sleep(time.Second * time.Duration(queryInterval))
+		select {
+		case <-ctx.Done():
+			server.shutdown()
+			return
+		case <-time.After(time.Second * time.Duration(config.queryInterval)):
+		}
+
+		// swap in the latest annotations between two cycles, keeping the old snapshots
+		select {
+		case annotations := <-reloads:
+			newConfig, changed, errReload := reloadSidecarConfig(config, annotations)
+			if errReload != nil {
+				log.Errorf("Error reloading sidecar config, keep the current config: %v", errReload)
+				reportInvalidConfig(errReload)
+			} else if changed {
+				if newConfig.listenPort != config.listenPort || newConfig.listenPath != config.listenPath {
+					log.Infof("Sidecar pushes new prometheus metric to %v", newConfig.listenPort+newConfig.listenPath)
+					server, newConfig, errListen = restartMetricsServer(server, config, newConfig, metricsHandler)
+					if errListen != nil {
+						log.Fatalf("Error listening on port %v: %v", newConfig.listenPort, errListen)
+					}
+				}
+				if newConfig.monascaUrl != config.monascaUrl || newConfig.keystoneUrl != config.keystoneUrl {
+					monasca = newMonascaForwarderForConfig(newConfig)
+					monascaPusher.stop()
+					monascaPusher = newMonascaPusher(ctx, monasca)
+				}
+				if newConfig.remoteWriteUrl != config.remoteWriteUrl || newConfig.remoteWriteMaxRetries != config.remoteWriteMaxRetries {
+					remoteWriter = newRemoteWriterForConfig(newConfig)
+					remoteWritePusher.stop()
+					remoteWritePusher = newRemoteWritePusher(ctx, remoteWriter)
+				}
+				oldSnapshots = oldSnapshots.resize(getSnapshotBufferCapacity(newConfig.sidecarRules, newConfig.queryInterval))
+				// forget the parsed selectors and expressions of the old rules, the new rules are parsed again on
+				// their first cycle
+				clearMetricSelectors()
+				clearExpressions()
+				config = newConfig
+				log.Infof("Reloaded sidecar config with %v rules", len(config.sidecarRules))
+			}
+		default:
+		}
 
 		// get a new set of prometheus metrics
-		newPrometheusMetrics := getPrometheusMetrics(prometheusUrl)
+		newPrometheusMetrics, errScrape := getPrometheusMetrics(ctx, config.prometheusUrl)
+		newScrapeTime := time.Now()
+		if ctx.Err() != nil {
+			// shutting down, the server is shut down at the top of the loop without waiting for pushes
+			continue
+		}
+		recordScrapeResult(errScrape)
+		if errScrape != nil {
+			// skip this cycle and keep the last good snapshot as old for the next one
+			log.Errorf("Error getting prometheus metrics, skip calculating sidecar rules: %v", errScrape)
+			sidecarExposition.publish(gatherSidecarMetrics())
+			continue
+		}
 
-		newPrometheusMetricsWithNoHistogramSummary := replaceHistogramSummaryToGauge(newPrometheusMetrics)
-		oldPrometheusMetricsWithNoHistogramSummary := replaceHistogramSummaryToGauge(oldPrometheusMetrics)
+		newSnapshot := newPrometheusSnapshot(replaceHistogramSummaryToGauge(newPrometheusMetrics), newScrapeTime)
 		// calculate by each sidecar rule
-		for _, rule := range sidecarRules {
-			switch rule.Function {
-			case "rate":
-				newRateMetrics = append(newRateMetrics, calculateRate(newPrometheusMetricsWithNoHistogramSummary, oldPrometheusMetricsWithNoHistogramSummary, queryInterval, rule)...)
-			case "avg":
-				newAvgMetrics = append(newAvgMetrics, calculateAvg(newPrometheusMetricsWithNoHistogramSummary, oldPrometheusMetricsWithNoHistogramSummary, rule)...)
-			case "ratio":
-				newRatioMetrics = append(newRatioMetrics, calculateRatio(newPrometheusMetricsWithNoHistogramSummary, rule)...)
-			case "deltaRatio":
-				newDeltaRatioMetrics = append(newDeltaRatioMetrics, calculateDeltaRatio(newPrometheusMetricsWithNoHistogramSummary, oldPrometheusMetricsWithNoHistogramSummary, rule)...)
-			case "delta":
-				newDeltaMetrics = append(newDeltaMetrics, calculateDelta(newPrometheusMetricsWithNoHistogramSummary, oldPrometheusMetricsWithNoHistogramSummary, rule)...)
-			default:
-				log.Errorf("Rule %v with invalid function %v", rule.Name, rule.Function)
-			}
+		newSidecarMetrics := calculateSidecarRules(config.sidecarRules, newSnapshot, oldSnapshots)
+		// push in the background so that a slow sink does not delay the next scrape
+		monascaPusher.enqueue(newSidecarMetrics, newScrapeTime)
+		remoteWriteMetrics := newSidecarMetrics
+		if config.remoteWritePassthrough {
+			remoteWriteMetrics = append(newPrometheusMetrics[:len(newPrometheusMetrics):len(newPrometheusMetrics)], newSidecarMetrics...)
 		}
-		oldPrometheusMetricString = convertMetricFamiliesIntoTextString(newPrometheusMetrics) + convertMetricFamiliesIntoTextString(newRateMetrics) + convertMetricFamiliesIntoTextString(newAvgMetrics) + convertMetricFamiliesIntoTextString(newRatioMetrics) + convertMetricFamiliesIntoTextString(newDeltaRatioMetrics) + convertMetricFamiliesIntoTextString(newDeltaMetrics)
-		// set current to old to prepare new collection in next for loop
-		oldPrometheusMetrics = newPrometheusMetrics
+		remoteWritePusher.enqueue(remoteWriteMetrics, newScrapeTime)
+		publishedMetrics := append(newPrometheusMetrics[:len(newPrometheusMetrics):len(newPrometheusMetrics)], newSidecarMetrics...)
+		sidecarExposition.publish(append(publishedMetrics, gatherSidecarMetrics()...))
+		// add current with the calculated metrics to old snapshots to prepare new collection in next for loop,
+		// so that rules reading other rules also find their old values
+		oldSnapshots.add(newSnapshot.withMetrics(newSidecarMetrics))
 	}
 }
 
@@ -105,7 +229,12 @@ func getPrometheusUrl(annotations map[string]string) (string, bool) {
 		return "", false
 	}
 
-	prefix := "http://localhost"
+	// the application runs in the same pod, or on another host in standalone mode
+	prometheusHost := annotations["sidecar/host"]
+	if prometheusHost == "" {
+		prometheusHost = "localhost"
+	}
+	prefix := "http://" + prometheusHost
 	if prometheusPath == "/" {
 		prometheusUrl := prefix + ":" + prometheusPort
 		return prometheusUrl, true
@@ -117,35 +246,113 @@ func getPrometheusUrl(annotations map[string]string) (string, bool) {
 	return prometheusUrl, true
 }
 
-func getPrometheusMetrics(prometheusUrl string) []*prometheusClient.MetricFamily {
+// getPrometheusMetrics scrapes with retries. The scrape and the sleep between retries stop as soon as the
+// context is cancelled.
+func getPrometheusMetrics(ctx context.Context, prometheusUrl string) ([]*prometheusClient.MetricFamily, error) {
 	// http.get prometheus url with retries
 	retryCount, retryDelay := getRetryParams()
+	var errScrape error
 	for i := 1; i <= retryCount; i++ {
-		resp, errGetProm := http.Get(prometheusUrl)
-		if errGetProm == nil && resp.ContentLength != 0 {
-			log.Debugf("Http Get works! resp = ", resp)
-			defer resp.Body.Close()
-			respBody, errRead := ioutil.ReadAll(resp.Body)
-			if errRead != nil {
-				log.Fatalf("Error reading response body")
+		result, err := scrapePrometheusMetrics(ctx, prometheusUrl)
+		if err == nil {
+			return result, nil
+		}
+		errScrape = err
+		log.Infof("Error scraping prometheus endpoint %v: %v. Retrying. Sleep %v seconds and retry %v.", prometheusUrl, err, retryDelay, i)
+		if i < retryCount {
+			// sleep for 10 seconds or how long retry_delay is
+			select {
+			case <-ctx.Done():
+				return nil, fmt.Errorf("stopped scraping prometheus endpoint %v: %v", prometheusUrl, errScrape)
+			case <-time.After(time.Second * time.Duration(retryDelay)):
 			}
-			result, errParse := parsePrometheusMetricsToMetricFamilies(string(respBody))
-			if errParse != nil {
-				log.Fatalf("Error parsing prometheus metrics to metric families")
+		}
+	}
+	return nil, fmt.Errorf("failed to scrape prometheus endpoint %v with %v times of retries: %v", prometheusUrl, retryCount, errScrape)
+}
+
+// scrapeAcceptHeader prefers the delimited protobuf format, which is the cheapest to parse, then the text format.
+// OpenMetrics is accepted for applications that only speak OpenMetrics.
+const scrapeAcceptHeader = `application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,` +
+	`text/plain;version=0.0.4;q=0.5,application/openmetrics-text;version=1.0.0;q=0.3,*/*;q=0.1`
+
+func scrapePrometheusMetrics(ctx context.Context, prometheusUrl string) ([]*prometheusClient.MetricFamily, error) {
+	req, errRequest := http.NewRequest("GET", prometheusUrl, nil)
+	if errRequest != nil {
+		return nil, errRequest
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", scrapeAcceptHeader)
+	resp, errGetProm := http.DefaultClient.Do(req)
+	if errGetProm != nil {
+		return nil, errGetProm
+	}
+	defer resp.Body.Close()
+	log.Debugf("Http Get works! resp = ", resp)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status %v", resp.Status)
+	}
+	if resp.ContentLength == 0 {
+		return nil, fmt.Errorf("empty response body")
+	}
+	respBody, errRead := ioutil.ReadAll(resp.Body)
+	if errRead != nil {
+		return nil, fmt.Errorf("error reading response body: %v", errRead)
+	}
+	result, errParse := decodePrometheusMetrics(respBody, resp.Header.Get("Content-Type"))
+	if errParse != nil {
+		return nil, fmt.Errorf("error parsing prometheus metrics to metric families: %v", errParse)
+	}
+	return result, nil
+}
+
+// decodePrometheusMetrics decodes the response body according to its content type. Anything but the delimited
+// protobuf format and OpenMetrics is parsed as text, like before content negotiation.
+func decodePrometheusMetrics(body []byte, contentType string) ([]*prometheusClient.MetricFamily, error) {
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == expfmt.ProtoType && params["proto"] == expfmt.ProtoProtocol && params["encoding"] == "delimited":
+		result := []*prometheusClient.MetricFamily{}
+		decoder := expfmt.NewDecoder(bytes.NewReader(body), expfmt.FmtProtoDelim)
+		for {
+			mf := &prometheusClient.MetricFamily{}
+			if err := decoder.Decode(mf); err == io.EOF {
+				return result, nil
+			} else if err != nil {
+				return nil, err
 			}
-			return result
+			addHistogramInfBuckets(mf)
+			result = append(result, mf)
 		}
-		log.Infof("Error scraping prometheus endpoint %v. Retrying. Sleep %v seconds and retry %v.", prometheusUrl, retryDelay, i)
-		// sleep for 10 seconds or how long retry_delay is
-		time.Sleep(time.Second * time.Duration(retryDelay))
-		if i == retryCount {
-			log.Fatalf("Failed to scrape prometheus endpoint %v with %v times of retries.", prometheusUrl, retryCount)
+	case mediaType == "application/openmetrics-text":
+		text, err := convertOpenMetricsToText(string(body))
+		if err != nil {
+			return nil, err
 		}
+		return parsePrometheusMetricsToMetricFamilies(text)
 	}
-	return []*prometheusClient.MetricFamily{}
+	return parsePrometheusMetricsToMetricFamilies(string(body))
 }
 
-func getPodAnnotations() map[string]string {
+// addHistogramInfBuckets adds the +Inf bucket left out of the protobuf format, so that histograms look the
+// same as parsed from text.
+func addHistogramInfBuckets(mf *prometheusClient.MetricFamily) {
+	if *mf.Type != prometheusClient.MetricType_HISTOGRAM {
+		return
+	}
+	for _, metric := range mf.Metric {
+		buckets := metric.Histogram.Bucket
+		if len(buckets) > 0 && math.IsInf(buckets[len(buckets)-1].GetUpperBound(), +1) {
+			continue
+		}
+		metric.Histogram.Bucket = append(buckets, &prometheusClient.Bucket{
+			UpperBound:      proto.Float64(math.Inf(+1)),
+			CumulativeCount: proto.Uint64(metric.Histogram.GetSampleCount()),
+		})
+	}
+}
+
+func getPodNamespaceAndName() (string, string) {
 	//get namespace and pod name from environment variables
 	podNamespace, ok := os.LookupEnv("SIDECAR_POD_NAMESPACE")
 	if !ok {
@@ -156,9 +363,10 @@ func getPodAnnotations() map[string]string {
 	if !ok {
 		log.Fatalf("%s not set\n", "SIDECAR_POD_NAME")
 	}
+	return podNamespace, podName
+}
 
-	// get annotations
-	annotations := map[string]string{}
+func newKubernetesClientSet() *kubernetes.Clientset {
 	// creates the in-cluster config
 	config, err := rest.InClusterConfig()
 	if err != nil {
@@ -169,6 +377,15 @@ func getPodAnnotations() map[string]string {
 	if err != nil {
 		log.Fatalf("Failed to creates the clientSet")
 	}
+	return clientSet
+}
+
+func getPodAnnotations() map[string]string {
+	podNamespace, podName := getPodNamespaceAndName()
+
+	// get annotations
+	annotations := map[string]string{}
+	clientSet := newKubernetesClientSet()
 
 	podGet, err := clientSet.CoreV1().Pods(podNamespace).Get(podName, metav1.GetOptions{})
 	if errors.IsNotFound(err) {
@@ -3,7 +3,15 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	prometheusClient "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"strconv"
 	"testing"
 )
@@ -63,4 +71,129 @@ func TestGetPrometheusUrlFromAnnotations(t *testing.T) {
 	prometheusUrl3, flag3 := getPrometheusUrl(annotations3)
 	assert.False(t, flag3)
 	assert.Equal(t, "", prometheusUrl3)
+
+	// application on another host in standalone mode
+	annotations4 := map[string]string{}
+	annotations4["prometheus.io/scrape"] = "true"
+	annotations4["sidecar/host"] = "app"
+	annotations4["sidecar/port"] = "5556"
+	prometheusUrl4, flag4 := getPrometheusUrl(annotations4)
+	assert.True(t, flag4)
+	assert.Equal(t, "http://app:5556/metrics", prometheusUrl4)
+}
+
+func TestGetPrometheusMetrics(t *testing.T) {
+	os.Setenv("RETRY_COUNT", "2")
+	os.Setenv("RETRY_DELAY", "0")
+	defer os.Unsetenv("RETRY_COUNT")
+	defer os.Unsetenv("RETRY_DELAY")
+
+	prometheusMetricsString := `# HELP request_count Counts requests by method and path
+# TYPE request_count counter
+request_count{method="GET",path="/rest/metrics"} 25
+`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, prometheusMetricsString)
+	}))
+	defer server.Close()
+	prometheusMetrics, err := getPrometheusMetrics(context.Background(), server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, prometheusMetricsString, convertMetricFamiliesIntoTextString(prometheusMetrics))
+
+	// unhealthy endpoint
+	requestCount := 0
+	unhealthyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unhealthyServer.Close()
+	prometheusMetrics, err = getPrometheusMetrics(context.Background(), unhealthyServer.URL)
+	assert.Error(t, err)
+	assert.Nil(t, prometheusMetrics)
+	assert.Equal(t, 2, requestCount)
+
+	// invalid exposition
+	invalidServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "request_count{method=GET} not a float\n")
+	}))
+	defer invalidServer.Close()
+	prometheusMetrics, err = getPrometheusMetrics(context.Background(), invalidServer.URL)
+	assert.Error(t, err)
+	assert.Nil(t, prometheusMetrics)
+}
+
+func TestGetPrometheusMetricsStopsWhenCancelled(t *testing.T) {
+	os.Setenv("RETRY_COUNT", "3")
+	os.Setenv("RETRY_DELAY", "60")
+	defer os.Unsetenv("RETRY_COUNT")
+	defer os.Unsetenv("RETRY_DELAY")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	requestCount := 0
+	unhealthyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		// the sidecar is stopped during the first scrape
+		cancel()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unhealthyServer.Close()
+	prometheusMetrics, err := getPrometheusMetrics(ctx, unhealthyServer.URL)
+	assert.Error(t, err)
+	assert.Nil(t, prometheusMetrics)
+	// no retry after sleeping for the retry delay
+	assert.Equal(t, 1, requestCount)
+}
+
+func TestScrapePrometheusMetricsNegotiatesFormat(t *testing.T) {
+	prometheusMetrics, err := parsePrometheusMetricsToMetricFamilies(`# HELP request_duration_seconds Request duration
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{le="0.5"} 2
+request_duration_seconds_bucket{le="+Inf"} 3
+request_duration_seconds_sum 2.5
+request_duration_seconds_count 3
+`)
+	assert.NoError(t, err)
+	// client libraries leave the +Inf bucket out of the protobuf format
+	protobufHistogram := proto.Clone(prometheusMetrics[0]).(*prometheusClient.MetricFamily)
+	protobufHistogram.Metric[0].Histogram.Bucket = protobufHistogram.Metric[0].Histogram.Bucket[:1]
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, expfmt.FmtProtoDelim, expfmt.Negotiate(r.Header))
+		assert.Equal(t, expfmt.FmtProtoDelim, negotiateFormat(r.Header))
+		w.Header().Set("Content-Type", string(expfmt.FmtProtoDelim))
+		expfmt.NewEncoder(w, expfmt.FmtProtoDelim).Encode(protobufHistogram)
+	}))
+	defer server.Close()
+	scrapedMetrics, err := scrapePrometheusMetrics(context.Background(), server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, convertMetricFamiliesIntoTextString(prometheusMetrics), convertMetricFamiliesIntoTextString(scrapedMetrics))
+
+	openMetricsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", string(fmtOpenMetrics))
+		writeOpenMetrics(w, prometheusMetrics)
+	}))
+	defer openMetricsServer.Close()
+	scrapedMetrics, err = scrapePrometheusMetrics(context.Background(), openMetricsServer.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, convertMetricFamiliesIntoTextString(prometheusMetrics), convertMetricFamiliesIntoTextString(scrapedMetrics))
+}
+
+func TestRecordScrapeResult(t *testing.T) {
+	recordScrapeResult(nil)
+	recordScrapeResult(fmt.Errorf("connection refused"))
+	recordScrapeResult(fmt.Errorf("connection refused"))
+	sidecarMetrics := map[string]float64{}
+	for _, mf := range gatherSidecarMetrics() {
+		value, _ := getValueBasedOnType(*mf.Type, *mf.Metric[0])
+		sidecarMetrics[*mf.Name] = value
+	}
+	assert.Equal(t, 0.0, sidecarMetrics["sidecar_scrape_up"])
+	assert.True(t, sidecarMetrics["sidecar_scrape_failures_total"] >= 2.0)
+
+	recordScrapeResult(nil)
+	for _, mf := range gatherSidecarMetrics() {
+		if *mf.Name == "sidecar_scrape_up" {
+			assert.Equal(t, 1.0, *mf.Metric[0].Gauge.Value)
+		}
+	}
 }
@@ -0,0 +1,103 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	prometheusClient "github.com/prometheus/client_model/go"
+)
+
+type indexedMetric struct {
+	metricType prometheusClient.MetricType
+	metric     *prometheusClient.Metric
+}
+
+// metricIndex finds series by metric family name and label fingerprint in constant time. It is built once
+// when a snapshot is created and shared by every rule, instead of scanning all metric families per series.
+// An index can extend a parent index with more metric families, e.g. the metrics calculated by rules.
+type metricIndex struct {
+	parent  *metricIndex
+	metrics map[string]indexedMetric
+}
+
+func newMetricIndex(prometheusMetrics []*prometheusClient.MetricFamily) *metricIndex {
+	index := &metricIndex{metrics: map[string]indexedMetric{}}
+	index.add(prometheusMetrics)
+	return index
+}
+
+// extend returns an index of the metric families on top of this index, which is not modified.
+func (index *metricIndex) extend(prometheusMetrics []*prometheusClient.MetricFamily) *metricIndex {
+	extended := &metricIndex{parent: index, metrics: map[string]indexedMetric{}}
+	extended.add(prometheusMetrics)
+	return extended
+}
+
+func (index *metricIndex) add(prometheusMetrics []*prometheusClient.MetricFamily) {
+	for _, pm := range prometheusMetrics {
+		for _, metric := range pm.Metric {
+			key := getMetricIndexKey(*pm.Name, metric.Label)
+			// keep the first series like a linear scan would
+			if _, exists := index.get(key); !exists {
+				index.metrics[key] = indexedMetric{metricType: *pm.Type, metric: metric}
+			}
+		}
+	}
+}
+
+// get looks the key up in the parent index first, so that series added earlier win. A nil index,
+// e.g. of a missing old snapshot, has no series.
+func (index *metricIndex) get(key string) (indexedMetric, bool) {
+	if index == nil {
+		return indexedMetric{}, false
+	}
+	if indexed, ok := index.parent.get(key); ok {
+		return indexed, true
+	}
+	indexed, ok := index.metrics[key]
+	return indexed, ok
+}
+
+func getMetricIndexKey(metricName string, labels []*prometheusClient.LabelPair) string {
+	return metricName + "{" + convertLabelsIntoKey(labels) + "}"
+}
+
+func (index *metricIndex) findMetric(metricName string, metricType prometheusClient.MetricType, labels []*prometheusClient.LabelPair) (*prometheusClient.Metric, bool) {
+	indexed, ok := index.get(getMetricIndexKey(metricName, labels))
+	if !ok || indexed.metricType != metricType {
+		return nil, false
+	}
+	return indexed.metric, true
+}
+
+func (index *metricIndex) findValue(metricName string, metricType prometheusClient.MetricType, labels []*prometheusClient.LabelPair) (float64, bool) {
+	metric, ok := index.findMetric(metricName, metricType, labels)
+	if !ok {
+		return 0.0, false
+	}
+	return getValueBasedOnType(metricType, *metric)
+}
+
+// findDenominatorMetric finds the denominator series with the numerator labels, ignoring a "ge" label
+// of the numerator. The denominator is a metric name or a selector the series has to match.
+func (index *metricIndex) findDenominatorMetric(denominator string, numeratorLabels []*prometheusClient.LabelPair) (indexedMetric, bool) {
+	selector, err := getMetricSelector(denominator)
+	if err != nil {
+		return indexedMetric{}, false
+	}
+	indexed, ok := index.get(getMetricIndexKey(selector.metricName, numeratorLabels))
+	if !ok {
+		indexed, ok = index.get(getMetricIndexKey(selector.metricName, removeLabel(numeratorLabels, "ge")))
+	}
+	if !ok || !selector.matches(indexed.metric.Label) {
+		return indexedMetric{}, false
+	}
+	return indexed, true
+}
+
+func (index *metricIndex) findDenominatorValue(denominator string, numeratorLabels []*prometheusClient.LabelPair) (float64, bool) {
+	indexed, ok := index.findDenominatorMetric(denominator, numeratorLabels)
+	if !ok {
+		return 0.0, false
+	}
+	return getValueBasedOnType(indexed.metricType, *indexed.metric)
+}
@@ -0,0 +1,100 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMetricIndexFindValueWithDifferentLabelOrder(t *testing.T) {
+	prometheusMetricsString := `
+# HELP request_count Counts requests by method and path
+# TYPE request_count counter
+request_count{method="GET",path="/rest/metrics"} 25
+request_count{method="POST",path="/rest/support"} 10
+`
+	metricFamilies, err := parsePrometheusMetricsToMetricFamilies(prometheusMetricsString)
+	assert.NoError(t, err)
+	index := newMetricIndex(metricFamilies)
+
+	labelPairs := []*dto.LabelPair{
+		{Name: proto.String("path"), Value: proto.String("/rest/support")},
+		{Name: proto.String("method"), Value: proto.String("POST")},
+	}
+	value, succeed := index.findValue("request_count", dto.MetricType_COUNTER, labelPairs)
+	assert.True(t, succeed)
+	assert.Equal(t, 10.0, value)
+
+	_, succeed = index.findValue("request_count", dto.MetricType_GAUGE, labelPairs)
+	assert.False(t, succeed)
+	_, succeed = index.findValue("request_count", dto.MetricType_COUNTER, labelPairs[:1])
+	assert.False(t, succeed)
+}
+
+func TestMetricIndexFindDenominatorValueWithoutGe(t *testing.T) {
+	prometheusMetricsString := `
+# HELP request_count Counts requests by method
+# TYPE request_count counter
+request_count{method="GET"} 25
+`
+	metricFamilies, err := parsePrometheusMetricsToMetricFamilies(prometheusMetricsString)
+	assert.NoError(t, err)
+	numeratorLabels := []*dto.LabelPair{
+		{Name: proto.String("method"), Value: proto.String("GET")},
+		{Name: proto.String("ge"), Value: proto.String("0.5")},
+	}
+	value, succeed := newMetricIndex(metricFamilies).findDenominatorValue("request_count", numeratorLabels)
+	assert.True(t, succeed)
+	assert.Equal(t, 25.0, value)
+}
+
+func TestCheckEqualLabelsWithDifferentLabelOrder(t *testing.T) {
+	a := []*dto.LabelPair{
+		{Name: proto.String("method"), Value: proto.String("GET")},
+		{Name: proto.String("path"), Value: proto.String("/rest/metrics")},
+	}
+	b := []*dto.LabelPair{a[1], a[0]}
+	assert.True(t, checkEqualLabels(a, b))
+	assert.False(t, checkEqualLabels(a, b[:1]))
+}
+
+func TestMetricIndexExtend(t *testing.T) {
+	prometheusMetricsString := `
+# HELP request_count Counts requests by method
+# TYPE request_count counter
+request_count{method="GET"} 25
+`
+	metricFamilies, err := parsePrometheusMetricsToMetricFamilies(prometheusMetricsString)
+	assert.NoError(t, err)
+	calculatedMetricsString := `
+# HELP request_count Counts requests by method
+# TYPE request_count counter
+request_count{method="GET"} 99
+# HELP request_rate request_rate
+# TYPE request_rate gauge
+request_rate{method="GET"} 2.5
+`
+	calculatedMetricFamilies, err := parsePrometheusMetricsToMetricFamilies(calculatedMetricsString)
+	assert.NoError(t, err)
+	index := newMetricIndex(metricFamilies)
+	extended := index.extend(calculatedMetricFamilies)
+
+	labelPairs := []*dto.LabelPair{{Name: proto.String("method"), Value: proto.String("GET")}}
+	// the parent index wins like a linear scan over the parent and the added metric families would
+	value, succeed := extended.findValue("request_count", dto.MetricType_COUNTER, labelPairs)
+	assert.True(t, succeed)
+	assert.Equal(t, 25.0, value)
+	value, succeed = extended.findValue("request_rate", dto.MetricType_GAUGE, labelPairs)
+	assert.True(t, succeed)
+	assert.Equal(t, 2.5, value)
+	// the parent index is not modified
+	_, succeed = index.findValue("request_rate", dto.MetricType_GAUGE, labelPairs)
+	assert.False(t, succeed)
+
+	var missingIndex *metricIndex
+	_, succeed = missingIndex.findValue("request_count", dto.MetricType_COUNTER, labelPairs)
+	assert.False(t, succeed)
+}
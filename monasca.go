@@ -0,0 +1,242 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	prometheusClient "github.com/prometheus/client_model/go"
+	log "github.hpe.com/kronos/kelog"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	monascaBatchSize   = 500
+	monascaHttpTimeout = 10 * time.Second
+	// renew the keystone token a bit before it expires
+	keystoneTokenRenewal = time.Minute
+)
+
+// monascaMetric is a metric in the format of the Monasca API.
+type monascaMetric struct {
+	Name       string            `json:"name"`
+	Dimensions map[string]string `json:"dimensions"`
+	Timestamp  int64             `json:"timestamp"`
+	Value      float64           `json:"value"`
+}
+
+// keystoneCredentials authenticate against Keystone v3 with a password. They are read from the
+// usual OpenStack environment variables, so they can come from a Kubernetes secret.
+type keystoneCredentials struct {
+	username          string
+	password          string
+	userDomainName    string
+	projectName       string
+	projectDomainName string
+}
+
+func getKeystoneCredentials() keystoneCredentials {
+	credentials := keystoneCredentials{
+		username:          os.Getenv("OS_USERNAME"),
+		password:          os.Getenv("OS_PASSWORD"),
+		userDomainName:    os.Getenv("OS_USER_DOMAIN_NAME"),
+		projectName:       os.Getenv("OS_PROJECT_NAME"),
+		projectDomainName: os.Getenv("OS_PROJECT_DOMAIN_NAME"),
+	}
+	if credentials.userDomainName == "" {
+		credentials.userDomainName = "Default"
+	}
+	if credentials.projectDomainName == "" {
+		credentials.projectDomainName = "Default"
+	}
+	return credentials
+}
+
+// monascaForwarder posts metrics to the Monasca API with a Keystone token.
+type monascaForwarder struct {
+	monascaUrl  string
+	keystoneUrl string
+	credentials keystoneCredentials
+	httpClient  *http.Client
+	token       string
+	tokenExpiry time.Time
+}
+
+func newMonascaForwarder(monascaUrl string, keystoneUrl string, credentials keystoneCredentials) *monascaForwarder {
+	return &monascaForwarder{
+		monascaUrl:  strings.TrimSuffix(monascaUrl, "/"),
+		keystoneUrl: strings.TrimSuffix(keystoneUrl, "/"),
+		credentials: credentials,
+		httpClient:  &http.Client{Timeout: monascaHttpTimeout},
+	}
+}
+
+// newMonascaForwarderForConfig returns nil when the config does not enable pushing to Monasca.
+func newMonascaForwarderForConfig(config sidecarConfig) *monascaForwarder {
+	if config.monascaUrl == "" {
+		return nil
+	}
+	return newMonascaForwarder(config.monascaUrl, config.keystoneUrl, getKeystoneCredentials())
+}
+
+// convertMetricFamiliesToMonascaMetrics converts every series into a Monasca metric with the labels as dimensions.
+// Series without timestamp get the given timestamp. Histograms and summaries have to be converted to gauges first.
+func convertMetricFamiliesToMonascaMetrics(prometheusMetrics []*prometheusClient.MetricFamily, timestamp time.Time) []monascaMetric {
+	monascaMetrics := []monascaMetric{}
+	for _, pm := range prometheusMetrics {
+		for _, metric := range pm.Metric {
+			value, succeed := getValueBasedOnType(*pm.Type, *metric)
+			if !succeed {
+				continue
+			}
+			// monasca does not accept NaN and infinite values
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				log.Debugf("Skip forwarding %v with value %v to monasca", *pm.Name, value)
+				continue
+			}
+			dimensions := map[string]string{}
+			for _, label := range metric.Label {
+				// monasca does not accept empty dimension values
+				if *label.Value != "" {
+					dimensions[*label.Name] = *label.Value
+				}
+			}
+			timestampMs := timestamp.UnixNano() / int64(time.Millisecond)
+			if metric.TimestampMs != nil {
+				timestampMs = *metric.TimestampMs
+			}
+			monascaMetrics = append(monascaMetrics, monascaMetric{Name: *pm.Name, Dimensions: dimensions, Timestamp: timestampMs, Value: value})
+		}
+	}
+	return monascaMetrics
+}
+
+// forward posts the metrics to the Monasca API in batches. Requests are cancelled with the context.
+func (f *monascaForwarder) forward(ctx context.Context, prometheusMetrics []*prometheusClient.MetricFamily, timestamp time.Time) error {
+	monascaMetrics := convertMetricFamiliesToMonascaMetrics(replaceHistogramSummaryToGauge(prometheusMetrics), timestamp)
+	for start := 0; start < len(monascaMetrics); start += monascaBatchSize {
+		end := start + monascaBatchSize
+		if end > len(monascaMetrics) {
+			end = len(monascaMetrics)
+		}
+		if err := f.postMetrics(ctx, monascaMetrics[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *monascaForwarder) postMetrics(ctx context.Context, monascaMetrics []monascaMetric) error {
+	body, err := json.Marshal(monascaMetrics)
+	if err != nil {
+		return fmt.Errorf("error converting metrics to json: %v", err)
+	}
+	statusCode, err := f.postWithToken(ctx, f.monascaUrl+"/v2.0/metrics", body)
+	if err == nil && statusCode == http.StatusUnauthorized {
+		// the token may have been revoked, authenticate again once
+		f.token = ""
+		statusCode, err = f.postWithToken(ctx, f.monascaUrl+"/v2.0/metrics", body)
+	}
+	if err != nil {
+		return err
+	}
+	if statusCode != http.StatusNoContent && statusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status %v from monasca", statusCode)
+	}
+	return nil
+}
+
+func (f *monascaForwarder) postWithToken(ctx context.Context, url string, body []byte) (int, error) {
+	token, err := f.getToken(ctx)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Auth-Token", token)
+	resp, err := f.httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error posting metrics to monasca: %v", err)
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, nil
+}
+
+// getToken returns the cached keystone token, or authenticates when it is missing or about to expire.
+func (f *monascaForwarder) getToken(ctx context.Context) (string, error) {
+	if f.token != "" && time.Now().Add(keystoneTokenRenewal).Before(f.tokenExpiry) {
+		return f.token, nil
+	}
+	token, expiry, err := f.authenticate(ctx)
+	if err != nil {
+		return "", err
+	}
+	f.token, f.tokenExpiry = token, expiry
+	return token, nil
+}
+
+func (f *monascaForwarder) authenticate(ctx context.Context) (string, time.Time, error) {
+	authRequest := map[string]interface{}{
+		"auth": map[string]interface{}{
+			"identity": map[string]interface{}{
+				"methods": []string{"password"},
+				"password": map[string]interface{}{
+					"user": map[string]interface{}{
+						"name":     f.credentials.username,
+						"password": f.credentials.password,
+						"domain":   map[string]string{"name": f.credentials.userDomainName},
+					},
+				},
+			},
+			"scope": map[string]interface{}{
+				"project": map[string]interface{}{
+					"name":   f.credentials.projectName,
+					"domain": map[string]string{"name": f.credentials.projectDomainName},
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(authRequest)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req, err := http.NewRequest("POST", f.keystoneUrl+"/auth/tokens", bytes.NewReader(body))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := f.httpClient.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("error authenticating with keystone: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", time.Time{}, fmt.Errorf("unexpected response status %v from keystone", resp.Status)
+	}
+	var authResponse struct {
+		Token struct {
+			ExpiresAt time.Time `json:"expires_at"`
+		} `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&authResponse); err != nil {
+		return "", time.Time{}, fmt.Errorf("error parsing keystone response: %v", err)
+	}
+	token := resp.Header.Get("X-Subject-Token")
+	if token == "" {
+		return "", time.Time{}, fmt.Errorf("keystone response has no token")
+	}
+	return token, authResponse.Token.ExpiresAt, nil
+}
@@ -0,0 +1,121 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	prometheusClient "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConvertMetricFamiliesToMonascaMetrics(t *testing.T) {
+	timestamp := time.Unix(1500000000, 0)
+	labels := []*prometheusClient.LabelPair{
+		{Name: proto.String("method"), Value: proto.String("GET")},
+		{Name: proto.String("path"), Value: proto.String("")},
+	}
+	prometheusMetrics := []*prometheusClient.MetricFamily{
+		createNewMetricFamilies("request_count_rate", labels, 2.5),
+		createNewMetricFamilies("request_count_ratio", nil, math.NaN()),
+	}
+	prometheusMetrics[0].Metric[0].TimestampMs = proto.Int64(1500000001000)
+	prometheusMetrics = append(prometheusMetrics, createNewMetricFamilies("request_count_avg", nil, 4.0))
+
+	monascaMetrics := convertMetricFamiliesToMonascaMetrics(prometheusMetrics, timestamp)
+	assert.Equal(t, []monascaMetric{
+		{Name: "request_count_rate", Dimensions: map[string]string{"method": "GET"}, Timestamp: 1500000001000, Value: 2.5},
+		{Name: "request_count_avg", Dimensions: map[string]string{}, Timestamp: 1500000000000, Value: 4.0},
+	}, monascaMetrics)
+}
+
+func TestMonascaForwarderForward(t *testing.T) {
+	authentications := 0
+	keystone := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v3/auth/tokens", r.URL.Path)
+		authRequest := map[string]interface{}{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&authRequest))
+		user := authRequest["auth"].(map[string]interface{})["identity"].(map[string]interface{})["password"].(map[string]interface{})["user"].(map[string]interface{})
+		assert.Equal(t, "sidecar", user["name"])
+		authentications++
+		w.Header().Set("X-Subject-Token", fmt.Sprintf("token-%v", authentications))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token": {"expires_at": "%v"}}`, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	defer keystone.Close()
+
+	// the first token is revoked by monasca
+	posted := []monascaMetric{}
+	monasca := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v2.0/metrics", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		if r.Header.Get("X-Auth-Token") == "token-1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		batch := []monascaMetric{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&batch))
+		posted = append(posted, batch...)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer monasca.Close()
+
+	forwarder := newMonascaForwarder(monasca.URL+"/", keystone.URL+"/v3", keystoneCredentials{username: "sidecar", password: "secret", projectName: "monitoring"})
+	prometheusMetrics := []*prometheusClient.MetricFamily{createNewMetricFamilies("request_count_rate", nil, 2.5)}
+	assert.NoError(t, forwarder.forward(context.Background(), prometheusMetrics, time.Unix(1500000000, 0)))
+	assert.Equal(t, 2, authentications)
+	assert.Equal(t, []monascaMetric{{Name: "request_count_rate", Dimensions: map[string]string{}, Timestamp: 1500000000000, Value: 2.5}}, posted)
+
+	// the renewed token is cached
+	assert.NoError(t, forwarder.forward(context.Background(), prometheusMetrics, time.Unix(1500000030, 0)))
+	assert.Equal(t, 2, authentications)
+	assert.Equal(t, 2, len(posted))
+}
+
+func TestMonascaForwarderErrors(t *testing.T) {
+	keystone := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer keystone.Close()
+	monasca := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}))
+	defer monasca.Close()
+	prometheusMetrics := []*prometheusClient.MetricFamily{createNewMetricFamilies("request_count_rate", nil, 2.5)}
+
+	forwarder := newMonascaForwarder(monasca.URL, keystone.URL, keystoneCredentials{})
+	assert.Error(t, forwarder.forward(context.Background(), prometheusMetrics, time.Now()))
+
+	// a valid token but a rejected batch
+	forwarder.token, forwarder.tokenExpiry = "token", time.Now().Add(time.Hour)
+	assert.Error(t, forwarder.forward(context.Background(), prometheusMetrics, time.Now()))
+
+	// nothing to push
+	assert.NoError(t, forwarder.forward(context.Background(), []*prometheusClient.MetricFamily{}, time.Now()))
+}
+
+func TestMonascaForwarderCancelled(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	prometheusMetrics := []*prometheusClient.MetricFamily{createNewMetricFamilies("request_count_rate", nil, 2.5)}
+
+	// neither keystone nor monasca are called once the sidecar is stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	forwarder := newMonascaForwarder(server.URL, server.URL, keystoneCredentials{})
+	assert.Error(t, forwarder.forward(ctx, prometheusMetrics, time.Now()))
+	forwarder.token, forwarder.tokenExpiry = "token", time.Now().Add(time.Hour)
+	assert.Error(t, forwarder.forward(ctx, prometheusMetrics, time.Now()))
+	assert.Equal(t, 0, requests)
+}
@@ -0,0 +1,292 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	prometheusClient "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.hpe.com/kronos/kelog"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// fmtOpenMetrics is the OpenMetrics 1.0 text format, which is not supported by the vendored expfmt.
+const fmtOpenMetrics expfmt.Format = `application/openmetrics-text; version=1.0.0; charset=utf-8`
+
+// openMetricsUnits are the base units of Prometheus metric names. A family named with one of them as suffix
+// is exposed with that # UNIT in OpenMetrics.
+var openMetricsUnits = []string{"seconds", "bytes", "joules", "grams", "meters", "volts", "amperes", "celsius", "ratio"}
+
+// negotiateFormat returns the format with the highest quality in the Accept header, preferring the first
+// one listed on a tie. The text format is returned when nothing supported is accepted.
+func negotiateFormat(header http.Header) expfmt.Format {
+	format, bestQuality := expfmt.FmtText, 0.0
+	for _, accept := range strings.Split(strings.Join(header["Accept"], ","), ",") {
+		params := strings.Split(accept, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		quality, encoding, proto := 1.0, "", ""
+		for _, param := range params[1:] {
+			keyValue := strings.SplitN(param, "=", 2)
+			if len(keyValue) != 2 {
+				continue
+			}
+			value := strings.Trim(strings.TrimSpace(keyValue[1]), `"`)
+			switch strings.ToLower(strings.TrimSpace(keyValue[0])) {
+			case "q":
+				if q, err := strconv.ParseFloat(value, 64); err == nil {
+					quality = q
+				}
+			case "encoding":
+				encoding = value
+			case "proto":
+				proto = value
+			}
+		}
+		if quality <= bestQuality {
+			continue
+		}
+		switch {
+		case mediaType == expfmt.ProtoType && proto == expfmt.ProtoProtocol && encoding == "delimited":
+			format, bestQuality = expfmt.FmtProtoDelim, quality
+		case mediaType == "application/openmetrics-text":
+			format, bestQuality = fmtOpenMetrics, quality
+		case mediaType == "text/plain" || mediaType == "*/*":
+			format, bestQuality = expfmt.FmtText, quality
+		}
+	}
+	return format
+}
+
+// mergeMetricFamilies merges metric families with the same name, e.g. the one family per series created by
+// rule functions, because the protobuf and OpenMetrics formats expect every family once. The metric families
+// are not modified since they are shared with the snapshots.
+func mergeMetricFamilies(metricFamilies []*prometheusClient.MetricFamily) []*prometheusClient.MetricFamily {
+	mergedMetricFamilies := []*prometheusClient.MetricFamily{}
+	mergedIndexes := map[string]int{}
+	for _, mf := range metricFamilies {
+		i, ok := mergedIndexes[*mf.Name]
+		if !ok {
+			mergedIndexes[*mf.Name] = len(mergedMetricFamilies)
+			mergedMetricFamilies = append(mergedMetricFamilies, &prometheusClient.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type, Metric: mf.Metric})
+			continue
+		}
+		merged := mergedMetricFamilies[i]
+		if *merged.Type != *mf.Type {
+			log.Debugf("Skip exposing %v of type %v, already exposed as %v", *mf.Name, *mf.Type, *merged.Type)
+			continue
+		}
+		merged.Metric = append(merged.Metric[:len(merged.Metric):len(merged.Metric)], mf.Metric...)
+	}
+	return mergedMetricFamilies
+}
+
+// writeOpenMetrics writes the metric families in the OpenMetrics text format, terminated by # EOF.
+// Families must have unique names, see mergeMetricFamilies. The unit is taken from the family name.
+// _created samples are not written because the client model does not carry the creation time.
+func writeOpenMetrics(out io.Writer, metricFamilies []*prometheusClient.MetricFamily) error {
+	w := bufio.NewWriter(out)
+	for _, mf := range metricFamilies {
+		name := *mf.Name
+		typeName := "unknown"
+		switch *mf.Type {
+		case prometheusClient.MetricType_COUNTER:
+			// the counter family is named without the _total suffix of its samples
+			name = strings.TrimSuffix(name, "_total")
+			typeName = "counter"
+		case prometheusClient.MetricType_GAUGE:
+			typeName = "gauge"
+		case prometheusClient.MetricType_HISTOGRAM:
+			typeName = "histogram"
+		case prometheusClient.MetricType_SUMMARY:
+			typeName = "summary"
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, typeName)
+		if unit := getOpenMetricsUnit(name); unit != "" {
+			fmt.Fprintf(w, "# UNIT %s %s\n", name, unit)
+		}
+		if mf.Help != nil && *mf.Help != "" {
+			fmt.Fprintf(w, "# HELP %s %s\n", name, escapeOpenMetricsString(*mf.Help))
+		}
+		for _, metric := range mf.Metric {
+			writeOpenMetricsMetric(w, name, *mf.Type, metric)
+		}
+	}
+	fmt.Fprint(w, "# EOF\n")
+	return w.Flush()
+}
+
+// getOpenMetricsUnit returns the base unit the family name ends with, or an empty string.
+func getOpenMetricsUnit(familyName string) string {
+	for _, unit := range openMetricsUnits {
+		if strings.HasSuffix(familyName, "_"+unit) {
+			return unit
+		}
+	}
+	return ""
+}
+
+func writeOpenMetricsMetric(w io.Writer, name string, metricType prometheusClient.MetricType, metric *prometheusClient.Metric) {
+	switch metricType {
+	case prometheusClient.MetricType_COUNTER:
+		writeOpenMetricsSample(w, name+"_total", metric, "", "", metric.Counter.GetValue())
+	case prometheusClient.MetricType_GAUGE:
+		writeOpenMetricsSample(w, name, metric, "", "", metric.Gauge.GetValue())
+	case prometheusClient.MetricType_HISTOGRAM:
+		hasInfBucket := false
+		for _, bucket := range metric.Histogram.Bucket {
+			writeOpenMetricsSample(w, name+"_bucket", metric, "le", formatOpenMetricsFloat(bucket.GetUpperBound()), float64(bucket.GetCumulativeCount()))
+			hasInfBucket = hasInfBucket || math.IsInf(bucket.GetUpperBound(), +1)
+		}
+		// the +Inf bucket is required and equals the count
+		if !hasInfBucket {
+			writeOpenMetricsSample(w, name+"_bucket", metric, "le", "+Inf", float64(metric.Histogram.GetSampleCount()))
+		}
+		writeOpenMetricsSample(w, name+"_count", metric, "", "", float64(metric.Histogram.GetSampleCount()))
+		writeOpenMetricsSample(w, name+"_sum", metric, "", "", metric.Histogram.GetSampleSum())
+	case prometheusClient.MetricType_SUMMARY:
+		for _, quantile := range metric.Summary.Quantile {
+			writeOpenMetricsSample(w, name, metric, "quantile", formatOpenMetricsFloat(quantile.GetQuantile()), quantile.GetValue())
+		}
+		writeOpenMetricsSample(w, name+"_count", metric, "", "", float64(metric.Summary.GetSampleCount()))
+		writeOpenMetricsSample(w, name+"_sum", metric, "", "", metric.Summary.GetSampleSum())
+	default:
+		writeOpenMetricsSample(w, name, metric, "", "", metric.Untyped.GetValue())
+	}
+}
+
+func writeOpenMetricsSample(w io.Writer, name string, metric *prometheusClient.Metric, extraLabelName string, extraLabelValue string, value float64) {
+	labels := []string{}
+	for _, label := range metric.Label {
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, label.GetName(), escapeOpenMetricsString(label.GetValue())))
+	}
+	if extraLabelName != "" {
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, extraLabelName, extraLabelValue))
+	}
+	fmt.Fprint(w, name)
+	if len(labels) > 0 {
+		fmt.Fprintf(w, "{%s}", strings.Join(labels, ","))
+	}
+	fmt.Fprintf(w, " %s", formatOpenMetricsFloat(value))
+	// OpenMetrics timestamps are in seconds
+	if metric.TimestampMs != nil {
+		fmt.Fprintf(w, " %s", strconv.FormatFloat(float64(*metric.TimestampMs)/1000, 'f', -1, 64))
+	}
+	fmt.Fprint(w, "\n")
+}
+
+func formatOpenMetricsFloat(value float64) string {
+	switch {
+	case math.IsInf(value, +1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func escapeOpenMetricsString(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
+
+// convertOpenMetricsToText rewrites an OpenMetrics exposition into the prometheus text format, which the vendored
+// expfmt can parse: counter families get their _total name back, _created samples, units and exemplars are
+// dropped and timestamps are converted from seconds to milliseconds.
+func convertOpenMetricsToText(exposition string) (string, error) {
+	out := &strings.Builder{}
+	familyNames := map[string]string{}
+	createdNames := map[string]bool{}
+	for _, line := range strings.Split(exposition, "\n") {
+		if line == "# EOF" {
+			return out.String(), nil
+		}
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) < 4 {
+				continue
+			}
+			name := fields[2]
+			switch fields[1] {
+			case "TYPE":
+				typeName := fields[3]
+				familyNames[name] = name
+				switch typeName {
+				case "counter":
+					familyNames[name] = name + "_total"
+					createdNames[name+"_created"] = true
+				case "histogram", "summary":
+					createdNames[name+"_created"] = true
+				case "info":
+					familyNames[name] = name + "_info"
+					typeName = "gauge"
+				case "stateset":
+					typeName = "gauge"
+				case "gauge":
+				default:
+					typeName = "untyped"
+				}
+				fmt.Fprintf(out, "# TYPE %s %s\n", familyNames[name], typeName)
+			case "HELP":
+				if familyName, ok := familyNames[name]; ok {
+					name = familyName
+				}
+				fmt.Fprintf(out, "# HELP %s %s\n", name, strings.Replace(fields[3], `\"`, `"`, -1))
+			}
+			continue
+		}
+		sample, err := convertOpenMetricsSample(line, createdNames)
+		if err != nil {
+			return "", err
+		}
+		out.WriteString(sample)
+	}
+	return "", fmt.Errorf("OpenMetrics exposition is missing # EOF")
+}
+
+func convertOpenMetricsSample(line string, createdNames map[string]bool) (string, error) {
+	// the metric name and labels end at the first space outside of the quoted label values
+	end, inQuotes := 0, false
+	for ; end < len(line); end++ {
+		c := line[end]
+		if inQuotes && c == '\\' {
+			end++
+		} else if c == '"' {
+			inQuotes = !inQuotes
+		} else if c == ' ' && !inQuotes {
+			break
+		}
+	}
+	nameEnd := strings.IndexAny(line[:end], "{")
+	if nameEnd < 0 {
+		nameEnd = end
+	}
+	if createdNames[line[:nameEnd]] {
+		return "", nil
+	}
+	rest := line[end:]
+	if exemplar := strings.Index(rest, "#"); exemplar >= 0 {
+		rest = rest[:exemplar]
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return "", fmt.Errorf("invalid OpenMetrics sample %q", line)
+	}
+	sample := line[:end] + " " + fields[0]
+	if len(fields) == 2 {
+		timestamp, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid OpenMetrics timestamp in %q", line)
+		}
+		sample += " " + strconv.FormatInt(int64(math.Round(timestamp*1000)), 10)
+	}
+	return sample + "\n", nil
+}
@@ -0,0 +1,115 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"bytes"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	testCases := map[string]expfmt.Format{
+		"":                         expfmt.FmtText,
+		"text/plain;version=0.0.4": expfmt.FmtText,
+		"application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited": expfmt.FmtProtoDelim,
+		"application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=text":      expfmt.FmtText,
+		"application/openmetrics-text; version=1.0.0; charset=utf-8":                                 fmtOpenMetrics,
+		"text/plain;q=0.5,application/openmetrics-text;version=0.0.1;q=0.9":                          fmtOpenMetrics,
+		"application/openmetrics-text;q=0.2,*/*;q=0.3":                                               expfmt.FmtText,
+		"application/json": expfmt.FmtText,
+	}
+	for accept, expectedFormat := range testCases {
+		header := http.Header{}
+		if accept != "" {
+			header.Set("Accept", accept)
+		}
+		assert.Equal(t, expectedFormat, negotiateFormat(header), accept)
+	}
+}
+
+func TestWriteOpenMetrics(t *testing.T) {
+	prometheusMetrics, err := parsePrometheusMetricsToMetricFamilies(`# HELP request_count Number of "requests"
+# TYPE request_count counter
+request_count{path="C:\\temp"} 25 1500000000123
+# TYPE process_cpu_seconds_total counter
+process_cpu_seconds_total 1.5
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{le="0.5"} 2
+request_duration_seconds_bucket{le="+Inf"} 3
+request_duration_seconds_sum 2.5
+request_duration_seconds_count 3
+# TYPE request_size summary
+request_size{quantile="0.5"} NaN
+request_size_sum 0
+request_size_count 0
+# TYPE version untyped
+version 2
+`)
+	assert.NoError(t, err)
+	out := &bytes.Buffer{}
+	assert.NoError(t, writeOpenMetrics(out, mergeMetricFamilies(prometheusMetrics)))
+	assert.Equal(t, `# TYPE process_cpu_seconds counter
+# UNIT process_cpu_seconds seconds
+process_cpu_seconds_total 1.5
+# TYPE request_count counter
+# HELP request_count Number of \"requests\"
+request_count_total{path="C:\\temp"} 25 1500000000.123
+# TYPE request_duration_seconds histogram
+# UNIT request_duration_seconds seconds
+request_duration_seconds_bucket{le="0.5"} 2
+request_duration_seconds_bucket{le="+Inf"} 3
+request_duration_seconds_count 3
+request_duration_seconds_sum 2.5
+# TYPE request_size summary
+request_size{quantile="0.5"} NaN
+request_size_count 0
+request_size_sum 0
+# TYPE version unknown
+version 2
+# EOF
+`, out.String())
+	// the client model has no creation time to write _created samples from
+	assert.NotContains(t, out.String(), "_created")
+}
+
+func TestGetOpenMetricsUnit(t *testing.T) {
+	assert.Equal(t, "seconds", getOpenMetricsUnit("request_duration_seconds"))
+	assert.Equal(t, "bytes", getOpenMetricsUnit("response_size_bytes"))
+	assert.Equal(t, "ratio", getOpenMetricsUnit("cache_hit_ratio"))
+	assert.Equal(t, "", getOpenMetricsUnit("request_count"))
+	assert.Equal(t, "", getOpenMetricsUnit("seconds"))
+}
+
+func TestConvertOpenMetricsToText(t *testing.T) {
+	text, err := convertOpenMetricsToText(`# TYPE request_count counter
+# HELP request_count Number of \"requests\"
+# UNIT request_count requests
+request_count_total{path="/a b",code="200"} 25 1500000000.123 # {trace_id="abc"} 1 1500000000.1
+request_count_created{path="/a b",code="200"} 1500000000
+# TYPE build info
+build_info{version="1.0"} 1
+# TYPE state unknown
+state 2
+# EOF
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, `# TYPE request_count_total counter
+# HELP request_count_total Number of "requests"
+request_count_total{path="/a b",code="200"} 25 1500000000123
+# TYPE build_info gauge
+build_info{version="1.0"} 1
+# TYPE state untyped
+state 2
+`, text)
+	_, err = parsePrometheusMetricsToMetricFamilies(text)
+	assert.NoError(t, err)
+
+	// a truncated exposition
+	_, err = convertOpenMetricsToText("# TYPE state gauge\nstate 2\n")
+	assert.Error(t, err)
+	_, err = convertOpenMetricsToText("state 2 3 4\n# EOF\n")
+	assert.Error(t, err)
+}
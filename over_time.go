@@ -0,0 +1,127 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	prometheusClient "github.com/prometheus/client_model/go"
+	log "github.hpe.com/kronos/kelog"
+	"math"
+	"time"
+)
+
+func init() {
+	registerRuleFunction("avgOverTime", overTimeFunction{aggregate: avgOverTime})
+	registerRuleFunction("minOverTime", overTimeFunction{aggregate: minOverTime})
+	registerRuleFunction("maxOverTime", overTimeFunction{aggregate: maxOverTime})
+	registerRuleFunction("lastOverTime", overTimeFunction{aggregate: lastOverTime})
+}
+
+type overTimeSample struct {
+	value     float64
+	timestamp time.Time
+}
+
+// overTimeFunction aggregates every sample of a series within the rule window.
+type overTimeFunction struct {
+	aggregate func(samples []overTimeSample) float64
+}
+
+func (overTimeFunction) ValidateParameters(rule SidecarRule) error {
+	if err := checkRequiredParameters(rule, "name", "window"); err != nil {
+		return err
+	}
+	return checkDurationParameters(rule, "window")
+}
+
+func (f overTimeFunction) Calculate(newSnapshot prometheusSnapshot, oldSnapshot prometheusSnapshot, rule SidecarRule) []*prometheusClient.MetricFamily {
+	return f.CalculateWindow([]prometheusSnapshot{oldSnapshot, newSnapshot}, rule)
+}
+
+func (f overTimeFunction) CalculateWindow(snapshots []prometheusSnapshot, rule SidecarRule) []*prometheusClient.MetricFamily {
+	return calculateOverTime(snapshots, rule, f.aggregate)
+}
+
+func calculateOverTime(snapshots []prometheusSnapshot, rule SidecarRule, aggregate func(samples []overTimeSample) float64) []*prometheusClient.MetricFamily {
+	newOverTimeMetrics := []*prometheusClient.MetricFamily{}
+	if len(snapshots) == 0 {
+		return newOverTimeMetrics
+	}
+	newSnapshot := snapshots[len(snapshots)-1]
+	for _, pm := range selectMetricFamilies(newSnapshot.metrics, rule.Parameters["name"]) {
+		// only series still present in the new snapshot are aggregated
+		for _, newM := range pm.Metric {
+			samples := []overTimeSample{}
+			for _, oldSnapshot := range snapshots[:len(snapshots)-1] {
+				oldM, succeedOld := oldSnapshot.index.findMetric(*pm.Name, *pm.Type, newM.Label)
+				if !succeedOld {
+					continue
+				}
+				oldValueFloat, succeedOldValue := getValueBasedOnType(*pm.Type, *oldM)
+				if !succeedOldValue {
+					continue
+				}
+				samples = append(samples, overTimeSample{value: oldValueFloat, timestamp: getSampleTimestamp(oldM, oldSnapshot.timestamp)})
+			}
+			newValueFloat, succeedNew := getValueBasedOnType(*pm.Type, *newM)
+			if !succeedNew {
+				log.Warnf("Error getting values from new prometheus metric: %v", *pm.Name)
+				continue
+			}
+			samples = append(samples, overTimeSample{value: newValueFloat, timestamp: getSampleTimestamp(newM, newSnapshot.timestamp)})
+
+			// store aggregated metric into a new metric family
+			newOverTimeMetrics = append(newOverTimeMetrics, createNewMetricFamilies(rule.Name, newM.Label, aggregate(samples)))
+		}
+	}
+	log.Debugf("Successfully calculated %v for rule %v", rule.Function, rule.Name)
+	log.Debugf("Over time metrics = %v", convertMetricFamiliesIntoTextString(newOverTimeMetrics))
+	return newOverTimeMetrics
+}
+
+func getSampleTimestamp(metric *prometheusClient.Metric, snapshotTimestamp time.Time) time.Time {
+	// prefer the timestamp from the exposition
+	if metric.TimestampMs != nil {
+		return time.Unix(0, *metric.TimestampMs*int64(time.Millisecond))
+	}
+	return snapshotTimestamp
+}
+
+// avgOverTime weights every sample by the time it covers, interpolating linearly between samples.
+func avgOverTime(samples []overTimeSample) float64 {
+	area := 0.0
+	duration := 0.0
+	for i := 1; i < len(samples); i++ {
+		seconds := samples[i].timestamp.Sub(samples[i-1].timestamp).Seconds()
+		area += (samples[i].value + samples[i-1].value) / 2.0 * seconds
+		duration += seconds
+	}
+	if duration <= 0 {
+		// a single sample or samples without elapsed time
+		sum := 0.0
+		for _, sample := range samples {
+			sum += sample.value
+		}
+		return sum / float64(len(samples))
+	}
+	return area / duration
+}
+
+func minOverTime(samples []overTimeSample) float64 {
+	min := math.Inf(+1)
+	for _, sample := range samples {
+		min = math.Min(min, sample.value)
+	}
+	return min
+}
+
+func maxOverTime(samples []overTimeSample) float64 {
+	max := math.Inf(-1)
+	for _, sample := range samples {
+		max = math.Max(max, sample.value)
+	}
+	return max
+}
+
+func lastOverTime(samples []overTimeSample) float64 {
+	return samples[len(samples)-1].value
+}
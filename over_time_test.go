@@ -0,0 +1,134 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func getQueueDepthSnapshots(t *testing.T) []prometheusSnapshot {
+	snapshots := []prometheusSnapshot{}
+	// samples at 0s, 30s, 60s and 120s, the GET series is missing from the second scrape
+	for i, prometheusMetricsString := range []string{`
+# HELP queue_depth Number of queued requests by method
+# TYPE queue_depth gauge
+queue_depth{method="GET"} 10
+queue_depth{method="POST"} 1
+`, `
+# HELP queue_depth Number of queued requests by method
+# TYPE queue_depth gauge
+queue_depth{method="POST"} 3
+`, `
+# HELP queue_depth Number of queued requests by method
+# TYPE queue_depth gauge
+queue_depth{method="GET"} 30
+queue_depth{method="POST"} 5
+`, `
+# HELP queue_depth Number of queued requests by method
+# TYPE queue_depth gauge
+queue_depth{method="GET"} 20
+queue_depth{method="POST"} 2
+`} {
+		metricFamilies, err := parsePrometheusMetricsToMetricFamilies(prometheusMetricsString)
+		assert.NoError(t, err)
+		timestamp := time.Unix(1520000000+30*int64(i), 0)
+		if i == 3 {
+			timestamp = time.Unix(1520000120, 0)
+		}
+		snapshots = append(snapshots, newPrometheusSnapshot(metricFamilies, timestamp))
+	}
+	return snapshots
+}
+
+func TestCalculateOverTime(t *testing.T) {
+	snapshots := getQueueDepthSnapshots(t)
+	overTimeRuleParam := map[string]string{}
+	overTimeRuleParam["name"] = "queue_depth"
+	overTimeRuleParam["window"] = "2m"
+	overTimeRule := SidecarRule{Name: "overTimeRuleTestName", Parameters: overTimeRuleParam}
+
+	// GET: ((10 + 30) / 2 * 60 + (30 + 20) / 2 * 60) / 120 = 22.5
+	// POST: ((1 + 3) / 2 * 30 + (3 + 5) / 2 * 30 + (5 + 2) / 2 * 60) / 120 = 3.25
+	avgOverTimeMetricString := convertMetricFamiliesIntoTextString(calculateOverTime(snapshots, overTimeRule, avgOverTime))
+	expectedAvgOverTimeMetricString := `# HELP overTimeRuleTestName overTimeRuleTestName
+# TYPE overTimeRuleTestName gauge
+overTimeRuleTestName{method="GET"} 22.5
+# HELP overTimeRuleTestName overTimeRuleTestName
+# TYPE overTimeRuleTestName gauge
+overTimeRuleTestName{method="POST"} 3.25
+`
+	assert.Equal(t, expectedAvgOverTimeMetricString, avgOverTimeMetricString)
+
+	minOverTimeMetricString := convertMetricFamiliesIntoTextString(calculateOverTime(snapshots, overTimeRule, minOverTime))
+	expectedMinOverTimeMetricString := `# HELP overTimeRuleTestName overTimeRuleTestName
+# TYPE overTimeRuleTestName gauge
+overTimeRuleTestName{method="GET"} 10
+# HELP overTimeRuleTestName overTimeRuleTestName
+# TYPE overTimeRuleTestName gauge
+overTimeRuleTestName{method="POST"} 1
+`
+	assert.Equal(t, expectedMinOverTimeMetricString, minOverTimeMetricString)
+
+	maxOverTimeMetricString := convertMetricFamiliesIntoTextString(calculateOverTime(snapshots, overTimeRule, maxOverTime))
+	expectedMaxOverTimeMetricString := `# HELP overTimeRuleTestName overTimeRuleTestName
+# TYPE overTimeRuleTestName gauge
+overTimeRuleTestName{method="GET"} 30
+# HELP overTimeRuleTestName overTimeRuleTestName
+# TYPE overTimeRuleTestName gauge
+overTimeRuleTestName{method="POST"} 5
+`
+	assert.Equal(t, expectedMaxOverTimeMetricString, maxOverTimeMetricString)
+
+	lastOverTimeMetricString := convertMetricFamiliesIntoTextString(calculateOverTime(snapshots, overTimeRule, lastOverTime))
+	expectedLastOverTimeMetricString := `# HELP overTimeRuleTestName overTimeRuleTestName
+# TYPE overTimeRuleTestName gauge
+overTimeRuleTestName{method="GET"} 20
+# HELP overTimeRuleTestName overTimeRuleTestName
+# TYPE overTimeRuleTestName gauge
+overTimeRuleTestName{method="POST"} 2
+`
+	assert.Equal(t, expectedLastOverTimeMetricString, lastOverTimeMetricString)
+}
+
+func TestCalculateSidecarRulesOverTime(t *testing.T) {
+	snapshots := getQueueDepthSnapshots(t)
+	sidecarRules, errUnmarshal := unmarshalSidecarRules(`
+- metricName: queue_depth_max_1m
+  function: maxOverTime
+  parameters:
+    name: queue_depth
+    window: 1m`)
+	assert.NoError(t, errUnmarshal)
+	oldSnapshots := newSnapshotBuffer(getSnapshotBufferCapacity(sidecarRules, 30.0))
+	for _, snapshot := range snapshots[:3] {
+		oldSnapshots.add(snapshot)
+	}
+
+	// only the scrapes at 60s and 120s are within 1 minute
+	newSidecarMetrics := calculateSidecarRules(sidecarRules, snapshots[3], oldSnapshots)
+	expectedSidecarMetricString := `# HELP queue_depth_max_1m queue_depth_max_1m
+# TYPE queue_depth_max_1m gauge
+queue_depth_max_1m{method="GET"} 30
+# HELP queue_depth_max_1m queue_depth_max_1m
+# TYPE queue_depth_max_1m gauge
+queue_depth_max_1m{method="POST"} 5
+`
+	assert.Equal(t, expectedSidecarMetricString, convertMetricFamiliesIntoTextString(newSidecarMetrics))
+}
+
+func TestAvgOverTimeWithSingleSample(t *testing.T) {
+	assert.Equal(t, 4.0, avgOverTime([]overTimeSample{{value: 4.0, timestamp: time.Unix(1520000000, 0)}}))
+}
+
+func TestValidateOverTimeParameters(t *testing.T) {
+	overTimeFunction, _ := getRuleFunction("maxOverTime")
+	overTimeRule := SidecarRule{Name: "queue_depth_max", Function: "maxOverTime", Parameters: map[string]string{"name": "queue_depth", "window": "1m"}}
+	assert.NoError(t, overTimeFunction.ValidateParameters(overTimeRule))
+	// a window has to cover some time
+	for _, window := range []string{"", "0s", "-1m"} {
+		overTimeRule.Parameters["window"] = window
+		assert.Error(t, overTimeFunction.ValidateParameters(overTimeRule), window)
+	}
+}
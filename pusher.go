@@ -0,0 +1,101 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"context"
+	"fmt"
+	prometheusClient "github.com/prometheus/client_model/go"
+	log "github.hpe.com/kronos/kelog"
+	"time"
+)
+
+// pushQueueSize is the number of cycles waiting for a slow sink before the metrics of new cycles are dropped.
+const pushQueueSize = 3
+
+type pushFunc func(ctx context.Context, prometheusMetrics []*prometheusClient.MetricFamily, timestamp time.Time) error
+
+type pushJob struct {
+	prometheusMetrics []*prometheusClient.MetricFamily
+	timestamp         time.Time
+}
+
+// asyncPusher pushes metrics to a sink from its own goroutine, so that a slow sink and its retries do not delay
+// the scrape loop. A nil asyncPusher pushes nothing.
+type asyncPusher struct {
+	sink   string
+	push   pushFunc
+	queue  chan pushJob
+	cancel context.CancelFunc
+}
+
+// newAsyncPusher starts pushing until stop is called or the context is cancelled.
+func newAsyncPusher(ctx context.Context, sink string, push pushFunc, queueSize int) *asyncPusher {
+	ctx, cancel := context.WithCancel(ctx)
+	pusher := &asyncPusher{
+		sink:   sink,
+		push:   push,
+		queue:  make(chan pushJob, queueSize),
+		cancel: cancel,
+	}
+	go pusher.run(ctx)
+	return pusher
+}
+
+// newMonascaPusher returns nil when the config does not enable pushing to Monasca.
+func newMonascaPusher(ctx context.Context, monasca *monascaForwarder) *asyncPusher {
+	if monasca == nil {
+		return nil
+	}
+	return newAsyncPusher(ctx, "monasca", monasca.forward, pushQueueSize)
+}
+
+// newRemoteWritePusher returns nil when the config does not enable pushing to a remote_write endpoint.
+func newRemoteWritePusher(ctx context.Context, remoteWriter *remoteWriter) *asyncPusher {
+	if remoteWriter == nil {
+		return nil
+	}
+	return newAsyncPusher(ctx, "remote_write", remoteWriter.write, pushQueueSize)
+}
+
+// enqueue queues the metrics of a cycle without blocking. When the queue is full the metrics are dropped
+// and counted as a failed push.
+func (p *asyncPusher) enqueue(prometheusMetrics []*prometheusClient.MetricFamily, timestamp time.Time) {
+	if p == nil {
+		return
+	}
+	select {
+	case p.queue <- pushJob{prometheusMetrics: prometheusMetrics, timestamp: timestamp}:
+	default:
+		errPush := fmt.Errorf("push queue is full, drop the metrics scraped at %v", timestamp)
+		recordPushResult(p.sink, errPush)
+		log.Errorf("Error pushing sidecar metrics to %v: %v", p.sink, errPush)
+	}
+}
+
+// stop cancels the running push and drops the queued ones.
+func (p *asyncPusher) stop() {
+	if p == nil {
+		return
+	}
+	p.cancel()
+}
+
+func (p *asyncPusher) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-p.queue:
+			errPush := p.push(ctx, job.prometheusMetrics, job.timestamp)
+			if ctx.Err() != nil {
+				// stopped or shutting down, not a failure of the sink
+				return
+			}
+			recordPushResult(p.sink, errPush)
+			if errPush != nil {
+				log.Errorf("Error pushing sidecar metrics to %v: %v", p.sink, errPush)
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"context"
+	"fmt"
+	prometheusClient "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func getPushFailures(t *testing.T, sink string) float64 {
+	metric := &prometheusClient.Metric{}
+	assert.NoError(t, pushFailuresTotal.WithLabelValues(sink).Write(metric))
+	return *metric.Counter.Value
+}
+
+func TestAsyncPusher(t *testing.T) {
+	pushed := make(chan time.Time)
+	release := make(chan struct{})
+	push := func(ctx context.Context, prometheusMetrics []*prometheusClient.MetricFamily, timestamp time.Time) error {
+		pushed <- timestamp
+		<-release
+		return fmt.Errorf("connection refused")
+	}
+	failures := getPushFailures(t, "test_async")
+	pusher := newAsyncPusher(context.Background(), "test_async", push, 1)
+	defer pusher.stop()
+
+	// the first push blocks in the sink, the second one waits in the queue and the third one is dropped
+	pusher.enqueue(nil, time.Unix(1520000000, 0))
+	assert.Equal(t, time.Unix(1520000000, 0), <-pushed)
+	pusher.enqueue(nil, time.Unix(1520000030, 0))
+	pusher.enqueue(nil, time.Unix(1520000060, 0))
+	assert.Equal(t, failures+1, getPushFailures(t, "test_async"))
+
+	release <- struct{}{}
+	assert.Equal(t, time.Unix(1520000030, 0), <-pushed)
+	release <- struct{}{}
+	// both pushes failed in the sink
+	assert.Eventually(t, func() bool { return getPushFailures(t, "test_async") == failures+3 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestAsyncPusherStop(t *testing.T) {
+	started := make(chan struct{})
+	stopped := make(chan error)
+	push := func(ctx context.Context, prometheusMetrics []*prometheusClient.MetricFamily, timestamp time.Time) error {
+		close(started)
+		<-ctx.Done()
+		stopped <- ctx.Err()
+		return ctx.Err()
+	}
+	failures := getPushFailures(t, "test_async_stop")
+	pusher := newAsyncPusher(context.Background(), "test_async_stop", push, 1)
+	pusher.enqueue(nil, time.Unix(1520000000, 0))
+	<-started
+	pusher.stop()
+
+	// the running push is cancelled and not counted as a failure of the sink
+	select {
+	case err := <-stopped:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "push was not cancelled")
+	}
+	assert.Equal(t, failures, getPushFailures(t, "test_async_stop"))
+
+	// a nil pusher pushes nothing
+	var nilPusher *asyncPusher
+	nilPusher.enqueue(nil, time.Unix(1520000000, 0))
+	nilPusher.stop()
+}
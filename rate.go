@@ -7,27 +7,64 @@ import (
 	log "github.hpe.com/kronos/kelog"
 )
 
-func calculateRate(newPrometheusMetrics []*prometheusClient.MetricFamily, oldPrometheusMetrics []*prometheusClient.MetricFamily, queryInterval float64, rule SidecarRule) []*prometheusClient.MetricFamily {
+func init() {
+	registerRuleFunction("rate", rateFunction{})
+}
+
+type rateFunction struct{}
+
+func (rateFunction) ValidateParameters(rule SidecarRule) error {
+	if err := checkRequiredParameters(rule, "name"); err != nil {
+		return err
+	}
+	if err := checkBoolParameters(rule, "compensateCounterReset"); err != nil {
+		return err
+	}
+	return checkDurationParameters(rule, "window")
+}
+
+func (rateFunction) Calculate(newSnapshot prometheusSnapshot, oldSnapshot prometheusSnapshot, rule SidecarRule) []*prometheusClient.MetricFamily {
+	return calculateRate(newSnapshot, oldSnapshot, rule)
+}
+
+func (rateFunction) CalculateWindow(snapshots []prometheusSnapshot, rule SidecarRule) []*prometheusClient.MetricFamily {
 	newRateMetrics := []*prometheusClient.MetricFamily{}
-	// find old value and new value
-	for _, pm := range newPrometheusMetrics {
-		if *pm.Name != rule.Parameters["name"] {
+	for _, windowIncrease := range getWindowIncreases(snapshots, rule.Parameters["name"], rule) {
+		if windowIncrease.elapsedSeconds <= 0 {
 			continue
 		}
+		rate := windowIncrease.increase / windowIncrease.elapsedSeconds
+		newRateMetrics = append(newRateMetrics, createNewMetricFamilies(rule.Name, windowIncrease.labels, rate))
+	}
+	log.Debugf("Successfully calculated rate over window for rule %v", rule.Name)
+	return newRateMetrics
+}
+
+func calculateRate(newSnapshot prometheusSnapshot, oldSnapshot prometheusSnapshot, rule SidecarRule) []*prometheusClient.MetricFamily {
+	newRateMetrics := []*prometheusClient.MetricFamily{}
+	queryInterval := getQueryInterval(newSnapshot, oldSnapshot)
+	// find old value and new value
+	for _, pm := range selectMetricFamilies(newSnapshot.metrics, rule.Parameters["name"]) {
 		for _, newM := range pm.Metric {
-			oldValueFloat, succeedOld := findOldValueWithMetricFamily(oldPrometheusMetrics, newM, *pm.Name, *pm.Type)
+			oldM, succeedOld := oldSnapshot.index.findMetric(*pm.Name, *pm.Type, newM.Label)
 			if succeedOld {
+				oldValueFloat, succeedOldValue := getValueBasedOnType(*pm.Type, *oldM)
+				if !succeedOldValue {
+					log.Warnf("Error getting values from old prometheus metric: %v", *pm.Name)
+					continue
+				}
 				// calculate rate
 				newValueFloat, succeedNew := getValueBasedOnType(*pm.Type, *newM)
 				if !succeedNew {
 					log.Warnf("Error getting values from new prometheus metric: %v", *pm.Name)
 					continue
 				}
-				if *pm.Type == prometheusClient.MetricType_COUNTER && newValueFloat < oldValueFloat {
+				increase, succeedIncrease := getIncrease(*pm.Type, newValueFloat, oldValueFloat, rule)
+				if !succeedIncrease {
 					log.Warnf("Counter %v has been reset", *pm.Name)
 					continue
 				}
-				rate := (newValueFloat - oldValueFloat) / queryInterval
+				rate := increase / getElapsedSeconds(newM, oldM, queryInterval)
 
 				// store rate metric into a new metric family
 				newRateMetrics = append(newRateMetrics, createNewMetricFamilies(rule.Name, newM.Label, rate))
@@ -38,3 +75,11 @@ func calculateRate(newPrometheusMetrics []*prometheusClient.MetricFamily, oldPro
 	log.Debugf("Rate metrics = ", convertMetricFamiliesIntoTextString(newRateMetrics))
 	return newRateMetrics
 }
+
+func getElapsedSeconds(newM *prometheusClient.Metric, oldM *prometheusClient.Metric, scrapeInterval float64) float64 {
+	// prefer the timestamps from the exposition when both samples have one
+	if newM.TimestampMs != nil && oldM.TimestampMs != nil && *newM.TimestampMs > *oldM.TimestampMs {
+		return float64(*newM.TimestampMs-*oldM.TimestampMs) / 1000.0
+	}
+	return scrapeInterval
+}
@@ -30,7 +30,7 @@ request_count{method="GET",path="/rest/metrics"} 30
 
 	for _, newMF := range newMetricFamilies {
 		for _, newMetric := range newMF.Metric {
-			oldValueFloat, succeedOld := findOldValueWithMetricFamily(oldMetricFamilies, newMetric, *newMF.Name, *newMF.Type)
+			oldValueFloat, succeedOld := newMetricIndex(oldMetricFamilies).findValue(*newMF.Name, *newMF.Type, newMetric.Label)
 			assert.Equal(t, oldValueFloat, 25.0)
 			assert.True(t, succeedOld)
 		}
@@ -71,7 +71,7 @@ request_total_time{method="POST",path="/rest/support"} 1.0
 
 	// (30 - 25) / 10.0 = 0.5
 	// (20 - 10) / 10.0 = 1.0
-	rateMetricFamilies := calculateRate(newMetricFamilies, oldMetricFamilies, queryInterval, rateRule)
+	rateMetricFamilies := calculateRate(newTestSnapshot(newMetricFamilies, queryInterval), newTestSnapshot(oldMetricFamilies, 0), rateRule)
 	rateMetricString := convertMetricFamiliesIntoTextString(rateMetricFamilies)
 	expectedRateMetricString := `# HELP rateRuleTestName rateRuleTestName
 # TYPE rateRuleTestName gauge
@@ -107,7 +107,7 @@ request_count{method="POST",path="/rest/support/2"} 20
 	rateRuleParam["name"] = "request_count"
 	rateRule := SidecarRule{Name: "rateRuleTestName", Function: "rate", Parameters: rateRuleParam}
 
-	rateMetricFamilies := calculateRate(newMetricFamilies, oldMetricFamilies, queryInterval, rateRule)
+	rateMetricFamilies := calculateRate(newTestSnapshot(newMetricFamilies, queryInterval), newTestSnapshot(oldMetricFamilies, 0), rateRule)
 	assert.Equal(t, 0, len(rateMetricFamilies))
 }
 
@@ -150,7 +150,7 @@ http_request_duration_seconds_count 149320
 	rateRuleParam["name"] = "http_request_duration_seconds_bucket"
 	rateRuleBucket := SidecarRule{Name: "rateRuleTestHistogramName", Function: "rate", Parameters: rateRuleParam}
 
-	rateMetricFamiliesBucket := calculateRate(newPrometheusMetricsWithNoHistogramSummary, oldPrometheusMetricsWithNoHistogramSummary, queryInterval, rateRuleBucket)
+	rateMetricFamiliesBucket := calculateRate(newTestSnapshot(newPrometheusMetricsWithNoHistogramSummary, queryInterval), newTestSnapshot(oldPrometheusMetricsWithNoHistogramSummary, 0), rateRuleBucket)
 	rateMetricStringBucket := convertMetricFamiliesIntoTextString(rateMetricFamiliesBucket)
 
 	expectedResultBucket := `# HELP rateRuleTestHistogramName rateRuleTestHistogramName
@@ -178,7 +178,7 @@ rateRuleTestHistogramName{le="1"} 200
 	rateRuleParam["name"] = "http_request_duration_seconds_sum"
 	rateRuleSum := SidecarRule{Name: "rateRuleTestHistogramName", Function: "rate", Parameters: rateRuleParam}
 
-	rateMetricFamiliesSum := calculateRate(newPrometheusMetricsWithNoHistogramSummary, oldPrometheusMetricsWithNoHistogramSummary, queryInterval, rateRuleSum)
+	rateMetricFamiliesSum := calculateRate(newTestSnapshot(newPrometheusMetricsWithNoHistogramSummary, queryInterval), newTestSnapshot(oldPrometheusMetricsWithNoHistogramSummary, 0), rateRuleSum)
 	rateMetricStringSum := convertMetricFamiliesIntoTextString(rateMetricFamiliesSum)
 
 	expectedResultSum := `# HELP rateRuleTestHistogramName rateRuleTestHistogramName
@@ -191,7 +191,7 @@ rateRuleTestHistogramName 1000
 	rateRuleParam["name"] = "http_request_duration_seconds_count"
 	rateRuleCount := SidecarRule{Name: "rateRuleTestHistogramName", Function: "rate", Parameters: rateRuleParam}
 
-	rateMetricFamiliesCount := calculateRate(newPrometheusMetricsWithNoHistogramSummary, oldPrometheusMetricsWithNoHistogramSummary, queryInterval, rateRuleCount)
+	rateMetricFamiliesCount := calculateRate(newTestSnapshot(newPrometheusMetricsWithNoHistogramSummary, queryInterval), newTestSnapshot(oldPrometheusMetricsWithNoHistogramSummary, 0), rateRuleCount)
 	rateMetricStringCount := convertMetricFamiliesIntoTextString(rateMetricFamiliesCount)
 
 	expectedResultCount := `# HELP rateRuleTestHistogramName rateRuleTestHistogramName
@@ -225,6 +225,77 @@ request_count{method="GET",path="/rest/metrics"} 5
 
 	// (30 - 25) / 10.0 = 0.5
 	// (20 - 10) / 10.0 = 1.0
-	rateMetricFamilies := calculateRate(newMetricFamilies, oldMetricFamilies, queryInterval, rateRule)
+	rateMetricFamilies := calculateRate(newTestSnapshot(newMetricFamilies, queryInterval), newTestSnapshot(oldMetricFamilies, 0), rateRule)
 	assert.Equal(t, 0, len(rateMetricFamilies))
 }
+
+func TestCalculateRateWithCompensatedCounterReset(t *testing.T) {
+	oldPrometheusMetricsString := `
+# HELP request_count Counts requests by method and path
+# TYPE request_count counter
+request_count{method="GET",path="/rest/metrics"} 25
+`
+	newPrometheusMetricsString := `
+# HELP request_count Counts requests by method and path
+# TYPE request_count counter
+request_count{method="GET",path="/rest/metrics"} 5
+`
+	oldMetricFamilies, errOldMF := parsePrometheusMetricsToMetricFamilies(oldPrometheusMetricsString)
+	newMetricFamilies, errNewMF := parsePrometheusMetricsToMetricFamilies(newPrometheusMetricsString)
+	assert.NoError(t, errOldMF)
+	assert.NoError(t, errNewMF)
+
+	// define queryInterval and rateRule
+	queryInterval := 10.0
+	rateRuleParam := map[string]string{}
+	rateRuleParam["name"] = "request_count"
+	rateRuleParam["compensateCounterReset"] = "true"
+	rateRule := SidecarRule{Name: "rateRuleTestName", Function: "rate", Parameters: rateRuleParam}
+
+	// counter has been reset, new value is the increase: 5 / 10.0 = 0.5
+	rateMetricFamilies := calculateRate(newTestSnapshot(newMetricFamilies, queryInterval), newTestSnapshot(oldMetricFamilies, 0), rateRule)
+	rateMetricString := convertMetricFamiliesIntoTextString(rateMetricFamilies)
+	expectedRateMetricString := `# HELP rateRuleTestName rateRuleTestName
+# TYPE rateRuleTestName gauge
+rateRuleTestName{method="GET",path="/rest/metrics"} 0.5
+`
+	assert.Equal(t, expectedRateMetricString, rateMetricString)
+}
+
+func TestCalculateRateWithTimestamps(t *testing.T) {
+	oldPrometheusMetricsString := `
+# HELP request_count Counts requests by method and path
+# TYPE request_count counter
+request_count{method="GET",path="/rest/metrics"} 25 1520000000000
+request_count{method="POST",path="/rest/support"} 10
+`
+	newPrometheusMetricsString := `
+# HELP request_count Counts requests by method and path
+# TYPE request_count counter
+request_count{method="GET",path="/rest/metrics"} 30 1520000020000
+request_count{method="POST",path="/rest/support"} 20 1520000020000
+`
+	oldMetricFamilies, errOldMF := parsePrometheusMetricsToMetricFamilies(oldPrometheusMetricsString)
+	newMetricFamilies, errNewMF := parsePrometheusMetricsToMetricFamilies(newPrometheusMetricsString)
+	assert.NoError(t, errOldMF)
+	assert.NoError(t, errNewMF)
+
+	// define queryInterval and rateRule
+	queryInterval := 10.0
+	rateRuleParam := map[string]string{}
+	rateRuleParam["name"] = "request_count"
+	rateRule := SidecarRule{Name: "rateRuleTestName", Function: "rate", Parameters: rateRuleParam}
+
+	// exposition timestamps are 20 seconds apart: (30 - 25) / 20.0 = 0.25
+	// old sample has no timestamp, use queryInterval: (20 - 10) / 10.0 = 1.0
+	rateMetricFamilies := calculateRate(newTestSnapshot(newMetricFamilies, queryInterval), newTestSnapshot(oldMetricFamilies, 0), rateRule)
+	rateMetricString := convertMetricFamiliesIntoTextString(rateMetricFamilies)
+	expectedRateMetricString := `# HELP rateRuleTestName rateRuleTestName
+# TYPE rateRuleTestName gauge
+rateRuleTestName{method="GET",path="/rest/metrics"} 0.25
+# HELP rateRuleTestName rateRuleTestName
+# TYPE rateRuleTestName gauge
+rateRuleTestName{method="POST",path="/rest/support"} 1
+`
+	assert.Equal(t, expectedRateMetricString, rateMetricString)
+}
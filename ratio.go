@@ -7,12 +7,31 @@ import (
 	log "github.hpe.com/kronos/kelog"
 )
 
-func calculateRatio(prometheusMetrics []*prometheusClient.MetricFamily, rule SidecarRule) []*prometheusClient.MetricFamily {
+func init() {
+	registerRuleFunction("ratio", ratioFunction{})
+}
+
+type ratioFunction struct{}
+
+func (ratioFunction) ValidateParameters(rule SidecarRule) error {
+	if err := checkRequiredParameters(rule, "numerator", "denominator"); err != nil {
+		return err
+	}
+	return validateVectorMatching(rule)
+}
+
+func (ratioFunction) Calculate(newSnapshot prometheusSnapshot, oldSnapshot prometheusSnapshot, rule SidecarRule) []*prometheusClient.MetricFamily {
+	return calculateRatio(newSnapshot, rule)
+}
+
+func calculateRatio(snapshot prometheusSnapshot, rule SidecarRule) []*prometheusClient.MetricFamily {
+	if hasVectorMatching(rule) {
+		newRatioMetrics := calculateRatioWithVectorMatching(getVectorSamples(snapshot.metrics, rule.Parameters["numerator"]), getVectorSamples(snapshot.metrics, rule.Parameters["denominator"]), rule)
+		log.Debugf("Successfully calculated ratio with vector matching for rule %v", rule.Name)
+		return newRatioMetrics
+	}
 	newRatioMetrics := []*prometheusClient.MetricFamily{}
-	for _, pm := range prometheusMetrics {
-		if *pm.Name != rule.Parameters["numerator"] {
-			continue
-		}
+	for _, pm := range selectMetricFamilies(snapshot.metrics, rule.Parameters["numerator"]) {
 		// get denominator value
 		for _, metric := range pm.Metric {
 			numeratorValueFloat, succeedNumerator := getValueBasedOnType(*pm.Type, *metric)
@@ -20,7 +39,7 @@ func calculateRatio(prometheusMetrics []*prometheusClient.MetricFamily, rule Sid
 				log.Errorf("Error getting numerator value from prometheus metric: %v", *pm.Name)
 				continue
 			}
-			denominatorValueFloat, succeedDenominator := findDenominatorValue(prometheusMetrics, metric.Label, rule.Parameters["denominator"])
+			denominatorValueFloat, succeedDenominator := snapshot.index.findDenominatorValue(rule.Parameters["denominator"], metric.Label)
 			if !succeedDenominator {
 				log.Errorf("Error getting denominator value from prometheus metric: %v", *pm.Name)
 				continue
@@ -28,7 +28,7 @@ request_total_time{method="POST",path="/rest/support"} 0.5
 
 	// 0.3 / 30 = 0.01
 	// 0.5 / 20 = 0.025
-	ratioMetricFamilies := calculateRatio(metricFamilies, ratioRule)
+	ratioMetricFamilies := calculateRatio(newTestSnapshot(metricFamilies, 0), ratioRule)
 	ratioMetricString := convertMetricFamiliesIntoTextString(ratioMetricFamilies)
 	expectedRatioMetricString := `# HELP ratioRuleTestName ratioRuleTestName
 # TYPE ratioRuleTestName gauge
@@ -55,7 +55,7 @@ request_count{method="POST",path="/rest/support/1"} 10
 	ratioRuleParam["denominator"] = "request_count"
 	ratioRule := SidecarRule{Name: "ratioRuleTestName", Function: "ratio", Parameters: ratioRuleParam}
 
-	ratioMetricFamilies := calculateRatio(metricFamilies, ratioRule)
+	ratioMetricFamilies := calculateRatio(newTestSnapshot(metricFamilies, 0), ratioRule)
 	assert.Equal(t, 0, len(ratioMetricFamilies))
 }
 
@@ -83,7 +83,7 @@ http_request_duration_seconds_count 200000
 	ratioRuleParam["denominator"] = "http_request_duration_seconds_count"
 	ratioRule := SidecarRule{Name: "ratioRuleTestHistogramName", Function: "ratio", Parameters: ratioRuleParam}
 
-	ratioMetricFamiliesBucket := calculateRatio(prometheusMetricsWithNoHistogramSummary, ratioRule)
+	ratioMetricFamiliesBucket := calculateRatio(newTestSnapshot(prometheusMetricsWithNoHistogramSummary, 0), ratioRule)
 	ratioMetricStringBucket := convertMetricFamiliesIntoTextString(ratioMetricFamiliesBucket)
 
 	// 50000 / 200000 = 0.25
@@ -116,7 +116,7 @@ request_count{method="GET",path="/rest/metrics"} 2
 	ratioRule := SidecarRule{Name: "requestBucketCountRatioTestName", Function: "ratio", Parameters: ratioRuleParam}
 
 	// delta ratio
-	ratioMetricFamilies := calculateRatio(metricFamilies, ratioRule)
+	ratioMetricFamilies := calculateRatio(newTestSnapshot(metricFamilies, 0), ratioRule)
 	ratioMetricFamiliesString := convertMetricFamiliesIntoTextString(ratioMetricFamilies)
 	expectedResult := `# HELP requestBucketCountRatioTestName requestBucketCountRatioTestName
 # TYPE requestBucketCountRatioTestName gauge
@@ -0,0 +1,85 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	log "github.hpe.com/kronos/kelog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"os"
+	"reflect"
+	"time"
+)
+
+const configFilePollInterval = 5 * time.Second
+
+// sendReload replaces annotations not yet picked up by the main loop, so that only the latest
+// annotations are applied.
+func sendReload(reloads chan map[string]string, annotations map[string]string) {
+	select {
+	case <-reloads:
+	default:
+	}
+	reloads <- annotations
+}
+
+// watchPodAnnotations sends the annotations of the pod every time the pod or its rules ConfigMap changes.
+func watchPodAnnotations(reloads chan map[string]string) {
+	podNamespace, podName := getPodNamespaceAndName()
+	clientSet := newKubernetesClientSet()
+	_, retryDelay := getRetryParams()
+	for {
+		podWatch, err := clientSet.CoreV1().Pods(podNamespace).Watch(metav1.ListOptions{
+			FieldSelector: fields.OneTermEqualSelector("metadata.name", podName).String(),
+		})
+		if err != nil {
+			log.Errorf("Error watching pod %v in namespace %v: %v", podName, podNamespace, err)
+			time.Sleep(time.Second * time.Duration(retryDelay))
+			continue
+		}
+		watchPodEvents(clientSet.CoreV1().ConfigMaps(podNamespace), podWatch, reloads, time.Second*time.Duration(retryDelay))
+		// the API server closes watches after a timeout
+		log.Debugf("Watch of pod %v closed, watch again", podName)
+	}
+}
+
+// watchConfigFile sends the annotations of the config file every time the file changes, until stop is closed.
+// The first check always sends the annotations, so a change made before the watch started is not missed.
+func watchConfigFile(configFile string, pollInterval time.Duration, reloads chan map[string]string, stop <-chan struct{}) {
+	lastModTime, lastSize := time.Time{}, int64(-1)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(pollInterval):
+		}
+		info, err := os.Stat(configFile)
+		if err != nil {
+			log.Warnf("Error checking config file %v: %v", configFile, err)
+			continue
+		}
+		if info.ModTime().Equal(lastModTime) && info.Size() == lastSize {
+			continue
+		}
+		lastModTime, lastSize = info.ModTime(), info.Size()
+		annotations, err := loadAnnotationsFromFile(configFile)
+		if err != nil {
+			log.Errorf("Error reloading config file: %v", err)
+			continue
+		}
+		sendReload(reloads, annotations)
+	}
+}
+
+// reloadSidecarConfig returns the config of the new annotations and whether it differs from the current one.
+// Invalid annotations keep the current config.
+func reloadSidecarConfig(currentConfig sidecarConfig, annotations map[string]string) (sidecarConfig, bool, error) {
+	newConfig, err := parseSidecarConfig(annotations)
+	if err != nil {
+		return currentConfig, false, err
+	}
+	if reflect.DeepEqual(newConfig, currentConfig) {
+		return currentConfig, false, nil
+	}
+	return newConfig, true, nil
+}
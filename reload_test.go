@@ -0,0 +1,90 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func getReloadTestAnnotations() map[string]string {
+	annotations := map[string]string{}
+	annotations["prometheus.io/scrape"] = "true"
+	annotations["prometheus.io/port"] = "9999"
+	annotations["sidecar/port"] = "5556"
+	annotations["sidecar/query-interval"] = "30"
+	annotations["sidecar/rules"] = `
+- metricName: request_count_rate
+  function: rate
+  parameters:
+    name: request_count`
+	return annotations
+}
+
+func TestReloadSidecarConfig(t *testing.T) {
+	annotations := getReloadTestAnnotations()
+	config, err := parseSidecarConfig(annotations)
+	assert.NoError(t, err)
+
+	// same annotations
+	_, changed, err := reloadSidecarConfig(config, getReloadTestAnnotations())
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	// invalid annotations keep the current config
+	annotations["sidecar/rules"] = "- metricName: [not a rule"
+	reloadedConfig, changed, err := reloadSidecarConfig(config, annotations)
+	assert.Error(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, config, reloadedConfig)
+
+	// new interval and listen port
+	annotations = getReloadTestAnnotations()
+	annotations["sidecar/query-interval"] = "10"
+	annotations["prometheus.io/port"] = "9998"
+	reloadedConfig, changed, err = reloadSidecarConfig(config, annotations)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, 10.0, reloadedConfig.queryInterval)
+	assert.Equal(t, "9998", reloadedConfig.listenPort)
+	assert.Equal(t, config.sidecarRules, reloadedConfig.sidecarRules)
+}
+
+func TestSendReloadKeepsLatestAnnotations(t *testing.T) {
+	reloads := make(chan map[string]string, 1)
+	sendReload(reloads, map[string]string{"sidecar/query-interval": "10"})
+	sendReload(reloads, map[string]string{"sidecar/query-interval": "20"})
+	assert.Equal(t, "20", (<-reloads)["sidecar/query-interval"])
+	assert.Equal(t, 0, len(reloads))
+}
+
+func TestWatchConfigFile(t *testing.T) {
+	configFile, err := ioutil.TempFile("", "sidecar-config")
+	assert.NoError(t, err)
+	defer os.Remove(configFile.Name())
+	_, err = configFile.WriteString("sidecar/query-interval: 30\n")
+	assert.NoError(t, err)
+	configFile.Close()
+
+	reloads := make(chan map[string]string, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchConfigFile(configFile.Name(), 10*time.Millisecond, reloads, stop)
+
+	assert.Equal(t, "30", waitForReload(t, reloads)["sidecar/query-interval"])
+	assert.NoError(t, ioutil.WriteFile(configFile.Name(), []byte("sidecar/query-interval: 10.5\n"), 0644))
+	assert.Equal(t, "10.5", waitForReload(t, reloads)["sidecar/query-interval"])
+}
+
+func waitForReload(t *testing.T, reloads chan map[string]string) map[string]string {
+	select {
+	case annotations := <-reloads:
+		return annotations
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "config file change was not reloaded")
+		return nil
+	}
+}
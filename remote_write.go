@@ -0,0 +1,182 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	prometheusClient "github.com/prometheus/client_model/go"
+	log "github.hpe.com/kronos/kelog"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	remoteWriteHttpTimeout = 10 * time.Second
+	remoteWriteMinBackoff  = time.Second
+	remoteWriteMaxBackoff  = 10 * time.Second
+	remoteWriteMaxRetries  = 3
+)
+
+// The messages below follow prompb/remote.proto and prompb/types.proto of Prometheus, so that a
+// WriteRequest can be encoded without depending on the Prometheus server code.
+
+type writeRequest struct {
+	Timeseries []*timeSeries `protobuf:"bytes,1,rep,name=timeseries"`
+}
+
+type timeSeries struct {
+	Labels  []*remoteLabel  `protobuf:"bytes,1,rep,name=labels"`
+	Samples []*remoteSample `protobuf:"bytes,2,rep,name=samples"`
+}
+
+type remoteLabel struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3"`
+}
+
+type remoteSample struct {
+	Value     float64 `protobuf:"fixed64,1,opt,name=value,proto3"`
+	Timestamp int64   `protobuf:"varint,2,opt,name=timestamp,proto3"`
+}
+
+func (m *writeRequest) Reset()         { *m = writeRequest{} }
+func (m *writeRequest) String() string { return proto.CompactTextString(m) }
+func (*writeRequest) ProtoMessage()    {}
+
+func (m *timeSeries) Reset()         { *m = timeSeries{} }
+func (m *timeSeries) String() string { return proto.CompactTextString(m) }
+func (*timeSeries) ProtoMessage()    {}
+
+func (m *remoteLabel) Reset()         { *m = remoteLabel{} }
+func (m *remoteLabel) String() string { return proto.CompactTextString(m) }
+func (*remoteLabel) ProtoMessage()    {}
+
+func (m *remoteSample) Reset()         { *m = remoteSample{} }
+func (m *remoteSample) String() string { return proto.CompactTextString(m) }
+func (*remoteSample) ProtoMessage()    {}
+
+// remoteWriter pushes metrics to a Prometheus remote_write endpoint such as Cortex or Thanos receive.
+type remoteWriter struct {
+	url        string
+	maxRetries int
+	minBackoff time.Duration
+	httpClient *http.Client
+}
+
+func newRemoteWriter(url string, maxRetries int) *remoteWriter {
+	return &remoteWriter{
+		url:        url,
+		maxRetries: maxRetries,
+		minBackoff: remoteWriteMinBackoff,
+		httpClient: &http.Client{Timeout: remoteWriteHttpTimeout},
+	}
+}
+
+// newRemoteWriterForConfig returns nil when the config does not enable remote_write.
+func newRemoteWriterForConfig(config sidecarConfig) *remoteWriter {
+	if config.remoteWriteUrl == "" {
+		return nil
+	}
+	return newRemoteWriter(config.remoteWriteUrl, config.remoteWriteMaxRetries)
+}
+
+// convertMetricFamiliesToTimeSeries converts every series into a time series with the metric name as __name__
+// label and labels sorted by name, as remote_write receivers expect. Series without timestamp get the given
+// timestamp. Histograms and summaries have to be converted to gauges first.
+func convertMetricFamiliesToTimeSeries(prometheusMetrics []*prometheusClient.MetricFamily, timestamp time.Time) []*timeSeries {
+	series := []*timeSeries{}
+	for _, pm := range prometheusMetrics {
+		for _, metric := range pm.Metric {
+			value, succeed := getValueBasedOnType(*pm.Type, *metric)
+			if !succeed {
+				continue
+			}
+			labels := []*remoteLabel{{Name: "__name__", Value: *pm.Name}}
+			for _, label := range metric.Label {
+				// an empty label is the same as a missing label
+				if *label.Value != "" {
+					labels = append(labels, &remoteLabel{Name: *label.Name, Value: *label.Value})
+				}
+			}
+			sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+			timestampMs := timestamp.UnixNano() / int64(time.Millisecond)
+			if metric.TimestampMs != nil {
+				timestampMs = *metric.TimestampMs
+			}
+			series = append(series, &timeSeries{Labels: labels, Samples: []*remoteSample{{Value: value, Timestamp: timestampMs}}})
+		}
+	}
+	return series
+}
+
+// encodeWriteRequest returns the snappy compressed protobuf body of a remote_write request.
+func encodeWriteRequest(series []*timeSeries) ([]byte, error) {
+	data, err := proto.Marshal(&writeRequest{Timeseries: series})
+	if err != nil {
+		return nil, err
+	}
+	return snappy.Encode(nil, data), nil
+}
+
+// write pushes the metrics in a single request, retrying with exponential backoff on network errors,
+// server errors and throttling. It gives up as soon as the context is cancelled.
+func (w *remoteWriter) write(ctx context.Context, prometheusMetrics []*prometheusClient.MetricFamily, timestamp time.Time) error {
+	series := convertMetricFamiliesToTimeSeries(replaceHistogramSummaryToGauge(prometheusMetrics), timestamp)
+	if len(series) == 0 {
+		return nil
+	}
+	body, err := encodeWriteRequest(series)
+	if err != nil {
+		return fmt.Errorf("error encoding remote write request: %v", err)
+	}
+	backoff := w.minBackoff
+	for i := 0; ; i++ {
+		retry, err := w.post(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || i >= w.maxRetries {
+			return err
+		}
+		log.Infof("Error writing to %v: %v. Sleep %v and retry %v.", w.url, err, backoff, i+1)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stopped retrying remote write request: %v", err)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > remoteWriteMaxBackoff {
+			backoff = remoteWriteMaxBackoff
+		}
+	}
+}
+
+// post sends the body once and returns whether a failed request can be retried.
+func (w *remoteWriter) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("error posting remote write request: %v", err)
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	// other client errors mean the samples are rejected and would be rejected again
+	retry := resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("unexpected response status %v from remote write endpoint", resp.Status)
+}
@@ -0,0 +1,125 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"context"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	prometheusClient "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRemoteWriteWireFormat(t *testing.T) {
+	// bytes as encoded by prompb
+	label, err := proto.Marshal(&remoteLabel{Name: "a", Value: "b"})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x0a, 0x01, 'a', 0x12, 0x01, 'b'}, label)
+	sample, err := proto.Marshal(&remoteSample{Value: 1.0, Timestamp: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x09, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f, 0x10, 0x01}, sample)
+}
+
+func TestConvertMetricFamiliesToTimeSeries(t *testing.T) {
+	labels := []*prometheusClient.LabelPair{
+		{Name: proto.String("path"), Value: proto.String("/")},
+		{Name: proto.String("code"), Value: proto.String("")},
+		{Name: proto.String("method"), Value: proto.String("GET")},
+	}
+	prometheusMetrics := []*prometheusClient.MetricFamily{createNewMetricFamilies("request_count_rate", labels, 2.5)}
+	series := convertMetricFamiliesToTimeSeries(prometheusMetrics, time.Unix(1500000000, 0))
+	assert.Equal(t, []*timeSeries{{
+		Labels: []*remoteLabel{
+			{Name: "__name__", Value: "request_count_rate"},
+			{Name: "method", Value: "GET"},
+			{Name: "path", Value: "/"},
+		},
+		Samples: []*remoteSample{{Value: 2.5, Timestamp: 1500000000000}},
+	}}, series)
+}
+
+func TestRemoteWriterWrite(t *testing.T) {
+	requests := 0
+	received := &writeRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "snappy", r.Header.Get("Content-Encoding"))
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		assert.Equal(t, "0.1.0", r.Header.Get("X-Prometheus-Remote-Write-Version"))
+		// fail the first request to check the retry
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		compressed, _ := ioutil.ReadAll(r.Body)
+		data, err := snappy.Decode(nil, compressed)
+		assert.NoError(t, err)
+		assert.NoError(t, proto.Unmarshal(data, received))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	writer := newRemoteWriter(server.URL, 3)
+	writer.minBackoff = time.Millisecond
+	prometheusMetrics := []*prometheusClient.MetricFamily{
+		createNewMetricFamilies("request_count_rate", nil, 2.5),
+		createNewMetricFamilies("request_count_ratio", nil, 0.5),
+	}
+	assert.NoError(t, writer.write(context.Background(), prometheusMetrics, time.Unix(1500000000, 0)))
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, 2, len(received.Timeseries))
+	assert.Equal(t, "request_count_ratio", received.Timeseries[1].Labels[0].Value)
+	assert.Equal(t, 0.5, received.Timeseries[1].Samples[0].Value)
+	assert.Equal(t, int64(1500000000000), received.Timeseries[1].Samples[0].Timestamp)
+}
+
+func TestRemoteWriterErrors(t *testing.T) {
+	requests := 0
+	status := http.StatusBadRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	prometheusMetrics := []*prometheusClient.MetricFamily{createNewMetricFamilies("request_count_rate", nil, 2.5)}
+
+	// rejected samples are not retried
+	writer := newRemoteWriter(server.URL, 2)
+	writer.minBackoff = time.Millisecond
+	assert.Error(t, writer.write(context.Background(), prometheusMetrics, time.Now()))
+	assert.Equal(t, 1, requests)
+
+	// throttling is retried until the retries are used up
+	requests = 0
+	status = http.StatusTooManyRequests
+	assert.Error(t, writer.write(context.Background(), prometheusMetrics, time.Now()))
+	assert.Equal(t, 3, requests)
+
+	// nothing to push
+	requests = 0
+	assert.NoError(t, writer.write(context.Background(), []*prometheusClient.MetricFamily{}, time.Now()))
+	assert.Equal(t, 0, requests)
+}
+
+func TestRemoteWriterStopsRetryingWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		// the sidecar is stopped while the endpoint is throttling
+		cancel()
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	prometheusMetrics := []*prometheusClient.MetricFamily{createNewMetricFamilies("request_count_rate", nil, 2.5)}
+
+	writer := newRemoteWriter(server.URL, 2)
+	writer.minBackoff = time.Hour
+	assert.Error(t, writer.write(ctx, prometheusMetrics, time.Now()))
+	assert.Equal(t, 1, requests)
+}
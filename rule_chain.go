@@ -0,0 +1,87 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// getReferencedMetricNames returns the metric names a rule reads from its parameters.
+func getReferencedMetricNames(rule SidecarRule) []string {
+	parameterNames := []string{}
+	for parameterName := range rule.Parameters {
+		parameterNames = append(parameterNames, parameterName)
+	}
+	sort.Strings(parameterNames)
+
+	metricNames := []string{}
+	for _, parameterName := range parameterNames {
+		parameterValue := rule.Parameters[parameterName]
+		if rule.Function == "expr" && parameterName == "expression" {
+			if expression, err := getExpression(parameterValue); err == nil {
+				metricNames = append(metricNames, getExpressionMetricNames(expression)...)
+			}
+			continue
+		}
+		if selector, err := parseMetricSelector(parameterValue); err == nil && selector.metricName != "" {
+			metricNames = append(metricNames, selector.metricName)
+		}
+	}
+	return metricNames
+}
+
+// sortSidecarRulesByDependency orders rules so that a rule referencing the metricName of another rule
+// is calculated after it. Rules without dependencies keep their order. A rule referencing its own
+// metricName reads the scraped metric, any other cycle is an error.
+func sortSidecarRulesByDependency(sidecarRules []SidecarRule) ([]SidecarRule, error) {
+	rulesByName := map[string][]int{}
+	for i, rule := range sidecarRules {
+		rulesByName[rule.Name] = append(rulesByName[rule.Name], i)
+	}
+	dependencies := make([][]int, len(sidecarRules))
+	for i, rule := range sidecarRules {
+		for _, metricName := range getReferencedMetricNames(rule) {
+			for _, j := range rulesByName[metricName] {
+				if j != i {
+					dependencies[i] = append(dependencies[i], j)
+				}
+			}
+		}
+	}
+
+	sortedRules := []SidecarRule{}
+	sorted := make([]bool, len(sidecarRules))
+	for len(sortedRules) < len(sidecarRules) {
+		// take the first rule whose dependencies are all calculated
+		next := -1
+		for i := range sidecarRules {
+			if !sorted[i] && allSorted(dependencies[i], sorted) {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			cycleRules := []string{}
+			for i, rule := range sidecarRules {
+				if !sorted[i] {
+					cycleRules = append(cycleRules, rule.Name)
+				}
+			}
+			return nil, fmt.Errorf("rules %v reference each other in a cycle", strings.Join(cycleRules, ", "))
+		}
+		sorted[next] = true
+		sortedRules = append(sortedRules, sidecarRules[next])
+	}
+	return sortedRules, nil
+}
+
+func allSorted(dependencies []int, sorted []bool) bool {
+	for _, dependency := range dependencies {
+		if !sorted[dependency] {
+			return false
+		}
+	}
+	return true
+}
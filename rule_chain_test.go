@@ -0,0 +1,120 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSortSidecarRulesByDependency(t *testing.T) {
+	sidecarRules, errUnmarshal := unmarshalSidecarRules(`
+- metricName: request_time_per_request
+  function: ratio
+  parameters:
+    numerator: request_total_time_rate
+    denominator: request_count_rate{method="GET"}
+- metricName: request_count_rate
+  function: rate
+  parameters:
+    name: request_count
+- metricName: request_time_percent
+  function: expr
+  parameters:
+    expression: request_time_per_request * 100
+- metricName: request_total_time_rate
+  function: rate
+  parameters:
+    name: request_total_time`)
+	assert.NoError(t, errUnmarshal)
+
+	sortedRules, err := sortSidecarRulesByDependency(sidecarRules)
+	assert.NoError(t, err)
+	sortedNames := []string{}
+	for _, rule := range sortedRules {
+		sortedNames = append(sortedNames, rule.Name)
+	}
+	assert.Equal(t, []string{"request_count_rate", "request_total_time_rate", "request_time_per_request", "request_time_percent"}, sortedNames)
+}
+
+func TestSortSidecarRulesByDependencyWithCycle(t *testing.T) {
+	sidecarRules, errUnmarshal := unmarshalSidecarRules(`
+- metricName: request_count
+  function: rate
+  parameters:
+    name: request_count
+- metricName: a
+  function: delta
+  parameters:
+    name: b
+- metricName: b
+  function: delta
+  parameters:
+    name: a`)
+	assert.NoError(t, errUnmarshal)
+
+	_, err := sortSidecarRulesByDependency(sidecarRules)
+	assert.EqualError(t, err, "rules a, b reference each other in a cycle")
+}
+
+func TestCalculateSidecarRulesWithChainedRules(t *testing.T) {
+	oldPrometheusMetricsString := `
+# HELP request_count Counts requests by method and path
+# TYPE request_count counter
+request_count{method="GET",path="/rest/metrics"} 25
+# HELP request_total_time Total time in second requests take by method and path
+# TYPE request_total_time counter
+request_total_time{method="GET",path="/rest/metrics"} 0.5
+`
+	newPrometheusMetricsString := `
+# HELP request_count Counts requests by method and path
+# TYPE request_count counter
+request_count{method="GET",path="/rest/metrics"} 30
+# HELP request_total_time Total time in second requests take by method and path
+# TYPE request_total_time counter
+request_total_time{method="GET",path="/rest/metrics"} 1.5
+`
+	oldMetricFamilies, errOldMF := parsePrometheusMetricsToMetricFamilies(oldPrometheusMetricsString)
+	newMetricFamilies, errNewMF := parsePrometheusMetricsToMetricFamilies(newPrometheusMetricsString)
+	assert.NoError(t, errOldMF)
+	assert.NoError(t, errNewMF)
+
+	sidecarRules, errUnmarshal := unmarshalSidecarRules(`
+- metricName: request_time_per_request
+  function: ratio
+  parameters:
+    numerator: request_total_time_rate
+    denominator: request_count_rate
+- metricName: request_count_rate
+  function: rate
+  parameters:
+    name: request_count
+- metricName: request_total_time_rate
+  function: rate
+  parameters:
+    name: request_total_time`)
+	assert.NoError(t, errUnmarshal)
+	sidecarRules, err := sortSidecarRulesByDependency(sidecarRules)
+	assert.NoError(t, err)
+
+	// (30 - 25) / 10.0 = 0.5
+	// (1.5 - 0.5) / 10.0 = 0.1
+	// 0.1 / 0.5 = 0.2
+	oldSnapshots := newSnapshotBuffer(1)
+	oldSnapshots.add(newPrometheusSnapshot(oldMetricFamilies, time.Unix(1520000000, 0)))
+	newSnapshot := newPrometheusSnapshot(newMetricFamilies, time.Unix(1520000010, 0))
+	sidecarMetricString := convertMetricFamiliesIntoTextString(calculateSidecarRules(sidecarRules, newSnapshot, oldSnapshots))
+	expectedSidecarMetricString := `# HELP request_count_rate request_count_rate
+# TYPE request_count_rate gauge
+request_count_rate{method="GET",path="/rest/metrics"} 0.5
+# HELP request_total_time_rate request_total_time_rate
+# TYPE request_total_time_rate gauge
+request_total_time_rate{method="GET",path="/rest/metrics"} 0.1
+# HELP request_time_per_request request_time_per_request
+# TYPE request_time_per_request gauge
+request_time_per_request{method="GET",path="/rest/metrics"} 0.2
+`
+	assert.Equal(t, expectedSidecarMetricString, sidecarMetricString)
+	assert.Equal(t, 2, len(newSnapshot.metrics))
+}
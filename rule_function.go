@@ -0,0 +1,141 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"fmt"
+	prometheusClient "github.com/prometheus/client_model/go"
+	log "github.hpe.com/kronos/kelog"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// RuleFunction is a calculation that can be referenced by the function field of a sidecar rule.
+type RuleFunction interface {
+	// ValidateParameters checks that the rule has every parameter the function needs.
+	ValidateParameters(rule SidecarRule) error
+	// Calculate computes new metric families from the new and the old snapshot, looking series up
+	// in the snapshot indexes.
+	Calculate(newSnapshot prometheusSnapshot, oldSnapshot prometheusSnapshot, rule SidecarRule) []*prometheusClient.MetricFamily
+}
+
+// WindowRuleFunction is implemented by rule functions that aggregate every snapshot within the rule
+// window instead of comparing the new snapshot with a single old one. CalculateWindow is only used
+// when the rule sets a window.
+type WindowRuleFunction interface {
+	RuleFunction
+	// CalculateWindow computes new metric families from snapshots ordered oldest first, the last one being the new snapshot.
+	CalculateWindow(snapshots []prometheusSnapshot, rule SidecarRule) []*prometheusClient.MetricFamily
+}
+
+var ruleFunctions = map[string]RuleFunction{}
+
+// registerRuleFunction makes a rule function available under the given name.
+// It is meant to be called from init() of the file implementing the function.
+func registerRuleFunction(name string, ruleFunction RuleFunction) {
+	if _, exists := ruleFunctions[name]; exists {
+		panic("rule function " + name + " registered twice")
+	}
+	ruleFunctions[name] = ruleFunction
+}
+
+func getRuleFunction(name string) (RuleFunction, bool) {
+	ruleFunction, ok := ruleFunctions[name]
+	return ruleFunction, ok
+}
+
+func getRuleFunctionNames() []string {
+	names := []string{}
+	for name := range ruleFunctions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func checkRequiredParameters(rule SidecarRule, parameterNames ...string) error {
+	for _, parameterName := range parameterNames {
+		if rule.Parameters[parameterName] == "" {
+			return fmt.Errorf("rule %v with function %v is missing parameter %v", rule.Name, rule.Function, parameterName)
+		}
+	}
+	return nil
+}
+
+func checkBoolParameters(rule SidecarRule, parameterNames ...string) error {
+	// optional parameters, only checked when set
+	for _, parameterName := range parameterNames {
+		parameterValue, ok := rule.Parameters[parameterName]
+		if !ok {
+			continue
+		}
+		if _, err := strconv.ParseBool(parameterValue); err != nil {
+			return fmt.Errorf("rule %v with function %v has invalid %v %v", rule.Name, rule.Function, parameterName, parameterValue)
+		}
+	}
+	return nil
+}
+
+func checkDurationParameters(rule SidecarRule, parameterNames ...string) error {
+	// optional parameters, only checked when set. Durations are windows, which have to be positive.
+	for _, parameterName := range parameterNames {
+		parameterValue, ok := rule.Parameters[parameterName]
+		if !ok {
+			continue
+		}
+		if duration, err := time.ParseDuration(parameterValue); err != nil || duration <= 0 {
+			return fmt.Errorf("rule %v with function %v has invalid %v %v", rule.Name, rule.Function, parameterName, parameterValue)
+		}
+	}
+	return nil
+}
+
+// calculateSidecarRules calculates rules in the given order. Every rule also sees the metrics calculated by the
+// rules before it, so rules have to be sorted with sortSidecarRulesByDependency.
+func calculateSidecarRules(sidecarRules []SidecarRule, newSnapshot prometheusSnapshot, oldSnapshots *snapshotBuffer) []*prometheusClient.MetricFamily {
+	newMetrics := []*prometheusClient.MetricFamily{}
+	// the calculated metrics are indexed on top of the snapshot index, which is not modified
+	chainedSnapshot := newSnapshot.withMetrics(nil)
+	for _, rule := range sidecarRules {
+		ruleFunction, ok := getRuleFunction(rule.Function)
+		if !ok {
+			log.Errorf("Rule %v with invalid function %v", rule.Name, rule.Function)
+			continue
+		}
+		if err := ruleFunction.ValidateParameters(rule); err != nil {
+			log.Errorf("Invalid rule: %v", err)
+			continue
+		}
+		if err := validateAggregation(rule); err != nil {
+			log.Errorf("Invalid rule: %v", err)
+			continue
+		}
+		if err := validateMetricSelectors(rule); err != nil {
+			log.Errorf("Invalid rule: %v", err)
+			continue
+		}
+		ruleMetrics := aggregateMetricFamilies(calculateSidecarRule(ruleFunction, rule, chainedSnapshot, oldSnapshots), rule)
+		chainedSnapshot.metrics = append(chainedSnapshot.metrics, ruleMetrics...)
+		chainedSnapshot.index.add(ruleMetrics)
+		newMetrics = append(newMetrics, ruleMetrics...)
+	}
+	return newMetrics
+}
+
+func calculateSidecarRule(ruleFunction RuleFunction, rule SidecarRule, newSnapshot prometheusSnapshot, oldSnapshots *snapshotBuffer) []*prometheusClient.MetricFamily {
+	window := getRuleWindow(rule)
+	if windowRuleFunction, ok := ruleFunction.(WindowRuleFunction); ok && window > 0 {
+		windowSnapshots := oldSnapshots.findSnapshotsInWindow(newSnapshot.timestamp, window)
+		if len(windowSnapshots) == 0 {
+			// window shorter than the query interval, use the previous snapshot
+			if oldSnapshot, ok := oldSnapshots.findOldSnapshot(newSnapshot.timestamp, window); ok {
+				windowSnapshots = append(windowSnapshots, oldSnapshot)
+			}
+		}
+		return windowRuleFunction.CalculateWindow(append(windowSnapshots, newSnapshot), rule)
+	}
+	// compare with the oldest snapshot within the rule window, or the previous snapshot without window
+	oldSnapshot, _ := oldSnapshots.findOldSnapshot(newSnapshot.timestamp, window)
+	return ruleFunction.Calculate(newSnapshot, oldSnapshot, rule)
+}
@@ -0,0 +1,94 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestGetRuleFunction(t *testing.T) {
+	assert.Equal(t, []string{"avg", "avgOverTime", "delta", "deltaRatio", "expr", "histogramQuantile", "lastOverTime", "maxOverTime", "minOverTime", "rate", "ratio"}, getRuleFunctionNames())
+	for _, name := range getRuleFunctionNames() {
+		_, ok := getRuleFunction(name)
+		assert.True(t, ok)
+	}
+	_, ok := getRuleFunction("sum")
+	assert.False(t, ok)
+}
+
+func TestValidateParameters(t *testing.T) {
+	rateFunction, _ := getRuleFunction("rate")
+	assert.NoError(t, rateFunction.ValidateParameters(SidecarRule{Name: "request_count_rate", Function: "rate", Parameters: map[string]string{"name": "request_count"}}))
+	assert.Error(t, rateFunction.ValidateParameters(SidecarRule{Name: "request_count_rate", Function: "rate"}))
+	assert.NoError(t, rateFunction.ValidateParameters(SidecarRule{Name: "request_count_rate", Function: "rate", Parameters: map[string]string{"name": "request_count", "compensateCounterReset": "true"}}))
+	assert.Error(t, rateFunction.ValidateParameters(SidecarRule{Name: "request_count_rate", Function: "rate", Parameters: map[string]string{"name": "request_count", "compensateCounterReset": "yes please"}}))
+
+	assert.NoError(t, rateFunction.ValidateParameters(SidecarRule{Name: "request_count_rate", Function: "rate", Parameters: map[string]string{"name": "request_count", "window": "5m"}}))
+	assert.Error(t, rateFunction.ValidateParameters(SidecarRule{Name: "request_count_rate", Function: "rate", Parameters: map[string]string{"name": "request_count", "window": "5 minutes"}}))
+	assert.Error(t, rateFunction.ValidateParameters(SidecarRule{Name: "request_count_rate", Function: "rate", Parameters: map[string]string{"name": "request_count", "window": "0s"}}))
+	assert.Error(t, rateFunction.ValidateParameters(SidecarRule{Name: "request_count_rate", Function: "rate", Parameters: map[string]string{"name": "request_count", "window": "-5m"}}))
+
+	ratioFunction, _ := getRuleFunction("ratio")
+	assert.NoError(t, ratioFunction.ValidateParameters(SidecarRule{Name: "request_ratio", Function: "ratio", Parameters: map[string]string{"numerator": "request_total_time", "denominator": "request_count"}}))
+	assert.Error(t, ratioFunction.ValidateParameters(SidecarRule{Name: "request_ratio", Function: "ratio", Parameters: map[string]string{"numerator": "request_total_time"}}))
+}
+
+func TestCalculateSidecarRules(t *testing.T) {
+	oldPrometheusMetricsString := `
+# HELP request_count Counts requests by method and path
+# TYPE request_count counter
+request_count{method="GET",path="/rest/metrics"} 25
+# HELP request_total_time Total time in second requests take by method and path
+# TYPE request_total_time counter
+request_total_time{method="GET",path="/rest/metrics"} 0.5
+`
+	newPrometheusMetricsString := `
+# HELP request_count Counts requests by method and path
+# TYPE request_count counter
+request_count{method="GET",path="/rest/metrics"} 30
+# HELP request_total_time Total time in second requests take by method and path
+# TYPE request_total_time counter
+request_total_time{method="GET",path="/rest/metrics"} 1.5
+`
+	oldMetricFamilies, errOldMF := parsePrometheusMetricsToMetricFamilies(oldPrometheusMetricsString)
+	newMetricFamilies, errNewMF := parsePrometheusMetricsToMetricFamilies(newPrometheusMetricsString)
+	assert.NoError(t, errOldMF)
+	assert.NoError(t, errNewMF)
+
+	sidecarRules, errUnmarshal := unmarshalSidecarRules(`
+- metricName: request_count_rate
+  function: rate
+  parameters:
+    name: request_count
+- metricName: request_count_unknown
+  function: unknown
+  parameters:
+    name: request_count
+- metricName: request_count_missing_denominator
+  function: ratio
+  parameters:
+    numerator: request_count
+- metricName: request_time_count_ratio
+  function: ratio
+  parameters:
+    numerator: request_total_time
+    denominator: request_count`)
+	assert.NoError(t, errUnmarshal)
+
+	// (30 - 25) / 10.0 = 0.5
+	// 1.5 / 30 = 0.05
+	oldSnapshots := newSnapshotBuffer(1)
+	oldSnapshots.add(newPrometheusSnapshot(oldMetricFamilies, time.Unix(1520000000, 0)))
+	newSnapshot := newPrometheusSnapshot(newMetricFamilies, time.Unix(1520000010, 0))
+	newSidecarMetrics := calculateSidecarRules(sidecarRules, newSnapshot, oldSnapshots)
+	expectedSidecarMetricString := `# HELP request_count_rate request_count_rate
+# TYPE request_count_rate gauge
+request_count_rate{method="GET",path="/rest/metrics"} 0.5
+# HELP request_time_count_ratio request_time_count_ratio
+# TYPE request_time_count_ratio gauge
+request_time_count_ratio{method="GET",path="/rest/metrics"} 0.05
+`
+	assert.Equal(t, expectedSidecarMetricString, convertMetricFamiliesIntoTextString(newSidecarMetrics))
+}
@@ -0,0 +1,57 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// ruleValidationError reports every problem found in the rules at once.
+type ruleValidationError struct {
+	problems []string
+}
+
+func (e ruleValidationError) Error() string {
+	return fmt.Sprintf("%v invalid sidecar rules:\n  %v", len(e.problems), strings.Join(e.problems, "\n  "))
+}
+
+// validateSidecarRules checks metric names, function names, parameters of each function, aggregation,
+// selectors and duplicated metric names of all rules.
+func validateSidecarRules(sidecarRules []SidecarRule) error {
+	problems := []string{}
+	ruleIndexes := map[string]int{}
+	for i, rule := range sidecarRules {
+		ruleId := fmt.Sprintf("rule %v", i+1)
+		if rule.Name != "" {
+			ruleId = fmt.Sprintf("rule %v (%v)", i+1, rule.Name)
+		}
+		if rule.Name == "" {
+			problems = append(problems, ruleId+": metricName can not be empty")
+		} else if !metricNameRegexp.MatchString(rule.Name) {
+			problems = append(problems, fmt.Sprintf("%v: metricName %v is not a valid prometheus metric name", ruleId, rule.Name))
+		} else if first, exists := ruleIndexes[rule.Name]; exists {
+			problems = append(problems, fmt.Sprintf("%v: metricName %v is already used by rule %v", ruleId, rule.Name, first+1))
+		} else {
+			ruleIndexes[rule.Name] = i
+		}
+
+		ruleFunction, ok := getRuleFunction(rule.Function)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%v: unknown function %q, valid functions are %v", ruleId, rule.Function, strings.Join(getRuleFunctionNames(), ", ")))
+			continue
+		}
+		for _, validate := range []func(SidecarRule) error{ruleFunction.ValidateParameters, validateAggregation, validateMetricSelectors} {
+			if err := validate(rule); err != nil {
+				problems = append(problems, fmt.Sprintf("%v: %v", ruleId, err))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return ruleValidationError{problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestValidateSidecarRules(t *testing.T) {
+	sidecarRules, errUnmarshal := unmarshalSidecarRules(`
+- metricName: request_count_rate
+  function: rate
+  parameters:
+    name: request_count
+- metricName: request_time_count_ratio
+  function: ratio
+  parameters:
+    numerator: request_total_time
+    denominator: request_count`)
+	assert.NoError(t, errUnmarshal)
+	assert.NoError(t, validateSidecarRules(sidecarRules))
+}
+
+func TestValidateSidecarRulesReportsAllProblems(t *testing.T) {
+	sidecarRules, errUnmarshal := unmarshalSidecarRules(`
+- metricName: request_count_rate
+  function: rate
+  parameters:
+    name: request_count
+- metricName: request_count_rate
+  function: rtae
+  parameters:
+    name: request_count
+- metricName: request-time-ratio
+  function: ratio
+  parameters:
+    numerator: request_total_time
+- function: delta
+  parameters:
+    name: request_count{code=~"5.."
+  aggregate: sum
+  by: [path]
+  without: [code]`)
+	assert.NoError(t, errUnmarshal)
+
+	err := validateSidecarRules(sidecarRules)
+	assert.Error(t, err)
+	validationError, ok := err.(ruleValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, []string{
+		"rule 2 (request_count_rate): metricName request_count_rate is already used by rule 1",
+		"rule 2 (request_count_rate): unknown function \"rtae\", valid functions are " + strings.Join(getRuleFunctionNames(), ", "),
+		"rule 3 (request-time-ratio): metricName request-time-ratio is not a valid prometheus metric name",
+		"rule 3 (request-time-ratio): rule request-time-ratio with function ratio is missing parameter denominator",
+		"rule 4: metricName can not be empty",
+		"rule 4: rule  can not set both by and without",
+		"rule 4: rule  with invalid selector: selector request_count{code=~\"5..\" is missing closing brace",
+	}, validationError.problems)
+	assert.Contains(t, err.Error(), "7 invalid sidecar rules:")
+}
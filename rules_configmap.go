@@ -0,0 +1,172 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"fmt"
+	log "github.hpe.com/kronos/kelog"
+	"gopkg.in/yaml.v2"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"sort"
+	"time"
+)
+
+type configMapGetter interface {
+	Get(name string, options metav1.GetOptions) (*v1.ConfigMap, error)
+}
+
+// resolveRulesConfigMap returns a copy of the annotations with the rules of the ConfigMap named by
+// sidecar/rules-configmap merged into sidecar/rules. Every key of the ConfigMap holds a list of rules.
+func resolveRulesConfigMap(annotations map[string]string, configMaps configMapGetter) (map[string]string, error) {
+	configMapName := annotations["sidecar/rules-configmap"]
+	if configMapName == "" {
+		return annotations, nil
+	}
+	configMap, err := configMaps.Get(configMapName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting rules ConfigMap %v: %v", configMapName, err)
+	}
+	keys := []string{}
+	for key := range configMap.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	sharedRules := []string{}
+	for _, key := range keys {
+		sharedRules = append(sharedRules, configMap.Data[key])
+	}
+
+	mergedRules, err := mergeSidecarRules(sharedRules, annotations["sidecar/rules"])
+	if err != nil {
+		return nil, fmt.Errorf("error merging rules of ConfigMap %v: %v", configMapName, err)
+	}
+	resolvedAnnotations := map[string]string{}
+	for key, value := range annotations {
+		resolvedAnnotations[key] = value
+	}
+	resolvedAnnotations["sidecar/rules"] = mergedRules
+	return resolvedAnnotations, nil
+}
+
+// mergeSidecarRules appends the inline rules to the shared rules. An inline rule replaces a shared rule
+// with the same metricName. Rules are merged as plain YAML so every field is kept as written.
+func mergeSidecarRules(sharedRules []string, inlineRules string) (string, error) {
+	inline := []yaml.MapSlice{}
+	if err := yaml.Unmarshal([]byte(inlineRules), &inline); err != nil {
+		return "", err
+	}
+	inlineNames := map[string]bool{}
+	for _, rule := range inline {
+		inlineNames[getRuleMetricName(rule)] = true
+	}
+
+	merged := []yaml.MapSlice{}
+	for _, rules := range sharedRules {
+		shared := []yaml.MapSlice{}
+		if err := yaml.Unmarshal([]byte(rules), &shared); err != nil {
+			return "", err
+		}
+		for _, rule := range shared {
+			if !inlineNames[getRuleMetricName(rule)] {
+				merged = append(merged, rule)
+			}
+		}
+	}
+	merged = append(merged, inline...)
+	if len(merged) == 0 {
+		return "", nil
+	}
+	text, err := yaml.Marshal(merged)
+	return string(text), err
+}
+
+func getRuleMetricName(rule yaml.MapSlice) string {
+	for _, item := range rule {
+		if item.Key == "metricName" {
+			return fmt.Sprint(item.Value)
+		}
+	}
+	return ""
+}
+
+// watchPodEvents sends the annotations of the pod, with the rules of its rules ConfigMap, every time the
+// pod or the ConfigMap changes, until the pod watch is closed. A ConfigMap watch that fails is retried after
+// the retry delay.
+func watchPodEvents(configMaps corev1.ConfigMapInterface, podWatch watch.Interface, reloads chan map[string]string, retryDelay time.Duration) {
+	var annotations map[string]string
+	var configMapWatch watch.Interface
+	var retryConfigMapWatch <-chan time.Time
+	configMapName := ""
+	startConfigMapWatch := func() {
+		configMapWatch = watchConfigMap(configMaps, configMapName)
+		retryConfigMapWatch = nil
+		if configMapWatch == nil && configMapName != "" {
+			retryConfigMapWatch = time.After(retryDelay)
+		}
+	}
+	defer func() {
+		if configMapWatch != nil {
+			configMapWatch.Stop()
+		}
+	}()
+	for {
+		var configMapEvents <-chan watch.Event
+		if configMapWatch != nil {
+			configMapEvents = configMapWatch.ResultChan()
+		}
+		select {
+		case event, ok := <-podWatch.ResultChan():
+			if !ok {
+				return
+			}
+			pod, isPod := event.Object.(*v1.Pod)
+			if !isPod || (event.Type != watch.Added && event.Type != watch.Modified) {
+				continue
+			}
+			annotations = pod.Annotations
+			if annotations["sidecar/rules-configmap"] != configMapName {
+				// watch the ConfigMap now referenced by the pod
+				if configMapWatch != nil {
+					configMapWatch.Stop()
+				}
+				configMapName = annotations["sidecar/rules-configmap"]
+				startConfigMapWatch()
+			}
+		case _, ok := <-configMapEvents:
+			if !ok {
+				// the API server closes watches after a timeout
+				startConfigMapWatch()
+			}
+		case <-retryConfigMapWatch:
+			// the ConfigMap may have changed while it was not watched
+			startConfigMapWatch()
+		}
+		if annotations == nil {
+			continue
+		}
+		resolvedAnnotations, err := resolveRulesConfigMap(annotations, configMaps)
+		if err != nil {
+			log.Errorf("Error reloading sidecar rules: %v", err)
+			continue
+		}
+		sendReload(reloads, resolvedAnnotations)
+	}
+}
+
+func watchConfigMap(configMaps corev1.ConfigMapInterface, configMapName string) watch.Interface {
+	if configMapName == "" {
+		return nil
+	}
+	configMapWatch, err := configMaps.Watch(metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", configMapName).String(),
+	})
+	if err != nil {
+		log.Errorf("Error watching rules ConfigMap %v, retry later: %v", configMapName, err)
+		return nil
+	}
+	return configMapWatch
+}
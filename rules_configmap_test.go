@@ -0,0 +1,162 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeConfigMaps map[string]*v1.ConfigMap
+
+func (f fakeConfigMaps) Get(name string, options metav1.GetOptions) (*v1.ConfigMap, error) {
+	configMap, ok := f[name]
+	if !ok {
+		return nil, fmt.Errorf("configmaps %q not found", name)
+	}
+	return configMap, nil
+}
+
+func TestResolveRulesConfigMap(t *testing.T) {
+	configMaps := fakeConfigMaps{"shared-rules": &v1.ConfigMap{Data: map[string]string{
+		"requests.yaml": `
+- metricName: request_count_rate
+  function: rate
+  parameters:
+    name: request_count
+- metricName: request_error_ratio
+  function: ratio
+  parameters:
+    numerator: request_errors
+    denominator: request_count
+  on: [path]
+  group_left: []`,
+		"latency.yaml": `
+- metricName: request_duration_p95
+  function: histogramQuantile
+  parameters:
+    name: http_request_duration_seconds
+    quantile: "0.95"`,
+	}}}
+	annotations := map[string]string{}
+	annotations["sidecar/rules-configmap"] = "shared-rules"
+	annotations["sidecar/rules"] = `
+- metricName: request_count_rate
+  function: rate
+  parameters:
+    name: request_count
+    window: 5m`
+
+	resolvedAnnotations, err := resolveRulesConfigMap(annotations, configMaps)
+	assert.NoError(t, err)
+	sidecarRules, errUnmarshal := unmarshalSidecarRules(resolvedAnnotations["sidecar/rules"])
+	assert.NoError(t, errUnmarshal)
+	assert.Equal(t, 3, len(sidecarRules))
+	// ConfigMap keys are merged in order, inline rules replace shared rules with the same name
+	assert.Equal(t, "request_duration_p95", sidecarRules[0].Name)
+	assert.Equal(t, "request_error_ratio", sidecarRules[1].Name)
+	assert.NotNil(t, sidecarRules[1].GroupLeft)
+	assert.Nil(t, sidecarRules[1].GroupRight)
+	assert.Nil(t, sidecarRules[1].By)
+	assert.Equal(t, "request_count_rate", sidecarRules[2].Name)
+	assert.Equal(t, "5m", sidecarRules[2].Parameters["window"])
+	// the annotations of the pod are not changed
+	inlineRules, errUnmarshal := unmarshalSidecarRules(annotations["sidecar/rules"])
+	assert.NoError(t, errUnmarshal)
+	assert.Equal(t, 1, len(inlineRules))
+
+	// only rules from the ConfigMap
+	delete(annotations, "sidecar/rules")
+	resolvedAnnotations, err = resolveRulesConfigMap(annotations, configMaps)
+	assert.NoError(t, err)
+	sidecarRules, errUnmarshal = unmarshalSidecarRules(resolvedAnnotations["sidecar/rules"])
+	assert.NoError(t, errUnmarshal)
+	assert.Equal(t, 3, len(sidecarRules))
+
+	annotations["sidecar/rules-configmap"] = "missing-rules"
+	_, err = resolveRulesConfigMap(annotations, configMaps)
+	assert.Error(t, err)
+}
+
+func TestResolveRulesConfigMapWithoutConfigMap(t *testing.T) {
+	annotations := map[string]string{"sidecar/rules": "- metricName: request_count_rate"}
+	resolvedAnnotations, err := resolveRulesConfigMap(annotations, fakeConfigMaps{})
+	assert.NoError(t, err)
+	assert.Equal(t, annotations, resolvedAnnotations)
+}
+
+// watchedConfigMaps serves a single ConfigMap, fails the given number of watches and then hands the fake
+// watches out to the test.
+type watchedConfigMaps struct {
+	corev1.ConfigMapInterface
+	lock          sync.Mutex
+	data          map[string]string
+	failedWatches int
+	watches       chan *watch.FakeWatcher
+}
+
+func (c *watchedConfigMaps) Get(name string, options metav1.GetOptions) (*v1.ConfigMap, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return &v1.ConfigMap{Data: c.data}, nil
+}
+
+func (c *watchedConfigMaps) Watch(options metav1.ListOptions) (watch.Interface, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.failedWatches > 0 {
+		c.failedWatches--
+		return nil, fmt.Errorf("connection refused")
+	}
+	configMapWatch := watch.NewFake()
+	c.watches <- configMapWatch
+	return configMapWatch, nil
+}
+
+func (c *watchedConfigMaps) setRules(rules string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.data = map[string]string{"requests.yaml": rules}
+}
+
+func TestWatchPodEventsRetriesConfigMapWatch(t *testing.T) {
+	configMaps := &watchedConfigMaps{failedWatches: 1, watches: make(chan *watch.FakeWatcher, 1)}
+	configMaps.setRules("- metricName: request_count_rate\n  function: rate\n  parameters:\n    name: request_count\n")
+	podWatch := watch.NewFake()
+	reloads := make(chan map[string]string, 1)
+	go watchPodEvents(configMaps, podWatch, reloads, 10*time.Millisecond)
+	defer podWatch.Stop()
+
+	// the first watch of the ConfigMap fails, the rules are still loaded
+	podWatch.Add(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"sidecar/rules-configmap": "shared-rules"}}})
+	assert.Contains(t, waitForReload(t, reloads)["sidecar/rules"], "request_count_rate")
+
+	// the watch is retried after the retry delay, reloading changes missed in between, and picks up changes
+	// of the ConfigMap
+	configMapWatch := waitForConfigMapWatch(t, configMaps)
+	assert.Contains(t, waitForReload(t, reloads)["sidecar/rules"], "request_count_rate")
+	configMaps.setRules("- metricName: request_error_rate\n  function: rate\n  parameters:\n    name: request_errors\n")
+	configMapWatch.Modify(&v1.ConfigMap{})
+	assert.Contains(t, waitForReload(t, reloads)["sidecar/rules"], "request_error_rate")
+
+	// a closed watch is watched again
+	configMapWatch.Stop()
+	waitForConfigMapWatch(t, configMaps)
+}
+
+func waitForConfigMapWatch(t *testing.T, configMaps *watchedConfigMaps) *watch.FakeWatcher {
+	select {
+	case configMapWatch := <-configMaps.watches:
+		return configMapWatch
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "ConfigMap was not watched")
+		return nil
+	}
+}
@@ -0,0 +1,230 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"fmt"
+	prometheusClient "github.com/prometheus/client_model/go"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	matchEqual     = "="
+	matchNotEqual  = "!="
+	matchRegexp    = "=~"
+	matchNotRegexp = "!~"
+)
+
+type labelMatcher struct {
+	name   string
+	op     string
+	value  string
+	regexp *regexp.Regexp
+}
+
+// metricSelector selects series like a PromQL instant vector selector, e.g. http_requests_total{code=~"5.."}.
+type metricSelector struct {
+	metricName string
+	matchers   []labelMatcher
+}
+
+func parseMetricSelector(selector string) (metricSelector, error) {
+	selector = strings.TrimSpace(selector)
+	braceIndex := strings.Index(selector, "{")
+	if braceIndex < 0 {
+		return metricSelector{metricName: selector}, nil
+	}
+	if !strings.HasSuffix(selector, "}") {
+		return metricSelector{}, fmt.Errorf("selector %v is missing closing brace", selector)
+	}
+	parsedSelector := metricSelector{metricName: strings.TrimSpace(selector[:braceIndex])}
+	rest := strings.TrimSpace(selector[braceIndex+1 : len(selector)-1])
+	for rest != "" {
+		// label name
+		i := 0
+		for i < len(rest) && isLabelNameChar(rest[i], i) {
+			i++
+		}
+		if i == 0 {
+			return metricSelector{}, fmt.Errorf("selector %v has invalid label name at %v", selector, rest)
+		}
+		matcher := labelMatcher{name: rest[:i]}
+		rest = strings.TrimSpace(rest[i:])
+
+		// match operator, longer operators first
+		for _, op := range []string{matchRegexp, matchNotRegexp, matchNotEqual, matchEqual} {
+			if strings.HasPrefix(rest, op) {
+				matcher.op = op
+				break
+			}
+		}
+		if matcher.op == "" {
+			return metricSelector{}, fmt.Errorf("selector %v has invalid match operator at %v", selector, rest)
+		}
+		rest = strings.TrimSpace(rest[len(matcher.op):])
+
+		// quoted label value
+		valueEnd := findClosingQuote(rest)
+		if valueEnd < 0 {
+			return metricSelector{}, fmt.Errorf("selector %v has invalid label value at %v", selector, rest)
+		}
+		value, err := strconv.Unquote(rest[:valueEnd+1])
+		if err != nil {
+			return metricSelector{}, fmt.Errorf("selector %v has invalid label value %v: %v", selector, rest[:valueEnd+1], err)
+		}
+		matcher.value = value
+		if matcher.op == matchRegexp || matcher.op == matchNotRegexp {
+			// regular expressions are fully anchored like in PromQL
+			matcher.regexp, err = regexp.Compile("^(?:" + value + ")$")
+			if err != nil {
+				return metricSelector{}, fmt.Errorf("selector %v has invalid regular expression %v: %v", selector, value, err)
+			}
+		}
+		parsedSelector.matchers = append(parsedSelector.matchers, matcher)
+
+		rest = strings.TrimSpace(rest[valueEnd+1:])
+		if strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		} else if rest != "" {
+			return metricSelector{}, fmt.Errorf("selector %v is missing comma at %v", selector, rest)
+		}
+	}
+	return parsedSelector, nil
+}
+
+func isLabelNameChar(c byte, position int) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (position > 0 && c >= '0' && c <= '9')
+}
+
+func findClosingQuote(s string) int {
+	if !strings.HasPrefix(s, "\"") {
+		return -1
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+func (m labelMatcher) matches(labels []*prometheusClient.LabelPair) bool {
+	// a missing label matches as empty string
+	labelValue := ""
+	for _, label := range labels {
+		if *label.Name == m.name {
+			labelValue = *label.Value
+			break
+		}
+	}
+	switch m.op {
+	case matchEqual:
+		return labelValue == m.value
+	case matchNotEqual:
+		return labelValue != m.value
+	case matchRegexp:
+		return m.regexp.MatchString(labelValue)
+	case matchNotRegexp:
+		return !m.regexp.MatchString(labelValue)
+	}
+	return false
+}
+
+func (s metricSelector) matches(labels []*prometheusClient.LabelPair) bool {
+	for _, matcher := range s.matchers {
+		if !matcher.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+type parsedMetricSelector struct {
+	selector metricSelector
+	err      error
+}
+
+var (
+	// selectors are parsed once instead of every time a rule is calculated, until the rules are reloaded
+	parsedMetricSelectors     = map[string]parsedMetricSelector{}
+	parsedMetricSelectorsLock sync.Mutex
+)
+
+// getMetricSelector parses a rule parameter, which is a metric name or a selector with label matchers.
+func getMetricSelector(parameterValue string) (metricSelector, error) {
+	parsedMetricSelectorsLock.Lock()
+	defer parsedMetricSelectorsLock.Unlock()
+	parsed, ok := parsedMetricSelectors[parameterValue]
+	if !ok {
+		parsed.selector, parsed.err = parseMetricSelector(parameterValue)
+		parsedMetricSelectors[parameterValue] = parsed
+	}
+	return parsed.selector, parsed.err
+}
+
+// clearMetricSelectors forgets the parsed selectors of the rules that are no longer used after a reload.
+func clearMetricSelectors() {
+	parsedMetricSelectorsLock.Lock()
+	defer parsedMetricSelectorsLock.Unlock()
+	parsedMetricSelectors = map[string]parsedMetricSelector{}
+}
+
+func validateMetricSelectors(rule SidecarRule) error {
+	for _, parameterValue := range rule.Parameters {
+		if !strings.Contains(parameterValue, "{") {
+			continue
+		}
+		if _, err := getMetricSelector(parameterValue); err != nil {
+			return fmt.Errorf("rule %v with invalid selector: %v", rule.Name, err)
+		}
+	}
+	return nil
+}
+
+// selectMetricFamilies returns the metric families selected by a rule parameter. The metric families keep
+// their name and only hold the series matching the label matchers, so that the series can be looked up in the
+// index of a snapshot by name and labels. An invalid selector selects nothing.
+func selectMetricFamilies(prometheusMetrics []*prometheusClient.MetricFamily, parameterValue string) []*prometheusClient.MetricFamily {
+	return selectMetricFamiliesWithSuffix(prometheusMetrics, parameterValue, "")
+}
+
+// selectMetricFamiliesWithSuffix selects series of histograms and summaries converted to gauges, whose metric
+// names are the selected name with a suffix such as _bucket.
+func selectMetricFamiliesWithSuffix(prometheusMetrics []*prometheusClient.MetricFamily, parameterValue string, suffix string) []*prometheusClient.MetricFamily {
+	selectedMetricFamilies := []*prometheusClient.MetricFamily{}
+	selector, err := getMetricSelector(parameterValue)
+	if err != nil {
+		return selectedMetricFamilies
+	}
+	for _, pm := range prometheusMetrics {
+		if *pm.Name != selector.metricName+suffix {
+			continue
+		}
+		if len(selector.matchers) == 0 {
+			selectedMetricFamilies = append(selectedMetricFamilies, pm)
+			continue
+		}
+		selectedMetricFamilies = append(selectedMetricFamilies, filterMetricFamily(pm, selector))
+	}
+	return selectedMetricFamilies
+}
+
+func filterMetricFamily(metricFamily *prometheusClient.MetricFamily, selector metricSelector) *prometheusClient.MetricFamily {
+	filteredMetricFamily := &prometheusClient.MetricFamily{
+		Name: metricFamily.Name,
+		Help: metricFamily.Help,
+		Type: metricFamily.Type,
+	}
+	for _, metric := range metricFamily.Metric {
+		if selector.matches(metric.Label) {
+			filteredMetricFamily.Metric = append(filteredMetricFamily.Metric, metric)
+		}
+	}
+	return filteredMetricFamily
+}
@@ -0,0 +1,189 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseMetricSelector(t *testing.T) {
+	selector, err := parseMetricSelector("http_requests_total")
+	assert.NoError(t, err)
+	assert.Equal(t, "http_requests_total", selector.metricName)
+	assert.Equal(t, 0, len(selector.matchers))
+
+	selector, err = parseMetricSelector(`http_requests_total{code=~"5..", method != "GET",path="/rest/\"quoted\"",handler!~"/(debug|health)"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "http_requests_total", selector.metricName)
+	assert.Equal(t, 4, len(selector.matchers))
+	assert.Equal(t, labelMatcher{name: "code", op: matchRegexp, value: "5..", regexp: selector.matchers[0].regexp}, selector.matchers[0])
+	assert.Equal(t, labelMatcher{name: "method", op: matchNotEqual, value: "GET"}, selector.matchers[1])
+	assert.Equal(t, labelMatcher{name: "path", op: matchEqual, value: `/rest/"quoted"`}, selector.matchers[2])
+	assert.Equal(t, matchNotRegexp, selector.matchers[3].op)
+
+	invalidSelectors := []string{
+		`http_requests_total{code=~"5.."`,
+		`http_requests_total{code~"5.."}`,
+		`http_requests_total{code=5}`,
+		`http_requests_total{code="500" method="GET"}`,
+		`http_requests_total{code=~"(5.."}`,
+		`http_requests_total{1code="500"}`,
+	}
+	for _, invalidSelector := range invalidSelectors {
+		_, err = parseMetricSelector(invalidSelector)
+		assert.Error(t, err, invalidSelector)
+	}
+}
+
+func TestMetricSelectorMatches(t *testing.T) {
+	labels := []*dto.LabelPair{
+		{Name: proto.String("code"), Value: proto.String("503")},
+		{Name: proto.String("method"), Value: proto.String("GET")},
+	}
+	for selectorString, expected := range map[string]bool{
+		`request_count{code="503"}`:                     true,
+		`request_count{code="50"}`:                      false,
+		`request_count{code!="200"}`:                    true,
+		`request_count{code=~"5.."}`:                    true,
+		`request_count{code=~"5"}`:                      false,
+		`request_count{code!~"5..",method="GET"}`:       false,
+		`request_count{path=""}`:                        true,
+		`request_count{path=~".+"}`:                     false,
+		`request_count{code=~"5..",method=~"GET|POST"}`: true,
+	} {
+		selector, err := parseMetricSelector(selectorString)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, selector.matches(labels), selectorString)
+	}
+}
+
+func TestCalculateSidecarRulesWithSelectors(t *testing.T) {
+	oldMetricFamilies, errOldMF := parsePrometheusMetricsToMetricFamilies(`
+# HELP http_requests_total Counts requests by code and method
+# TYPE http_requests_total counter
+http_requests_total{code="200",method="GET"} 100
+http_requests_total{code="500",method="GET"} 10
+http_requests_total{code="503",method="GET"} 20
+`)
+	newMetricFamilies, errNewMF := parsePrometheusMetricsToMetricFamilies(`
+# HELP http_requests_total Counts requests by code and method
+# TYPE http_requests_total counter
+http_requests_total{code="200",method="GET"} 200
+http_requests_total{code="500",method="GET"} 30
+http_requests_total{code="503",method="GET"} 60
+`)
+	assert.NoError(t, errOldMF)
+	assert.NoError(t, errNewMF)
+	sidecarRules, errUnmarshal := unmarshalSidecarRules(`
+- metricName: http_server_errors_rate
+  function: rate
+  parameters:
+    name: http_requests_total{code=~"5.."}
+  aggregate: sum
+- metricName: http_requests_delta
+  function: delta
+  parameters:
+    name: http_requests_total{code!~"5.."}
+- metricName: http_invalid_selector
+  function: delta
+  parameters:
+    name: http_requests_total{code=~"5.."`)
+	assert.NoError(t, errUnmarshal)
+	oldSnapshots := newSnapshotBuffer(1)
+	oldSnapshots.add(newPrometheusSnapshot(oldMetricFamilies, time.Unix(1520000000, 0)))
+	newSnapshot := newPrometheusSnapshot(newMetricFamilies, time.Unix(1520000010, 0))
+
+	// ((30 - 10) + (60 - 20)) / 10 = 6
+	// 200 - 100 = 100
+	newSidecarMetrics := calculateSidecarRules(sidecarRules, newSnapshot, oldSnapshots)
+	expectedSidecarMetricString := `# HELP http_server_errors_rate http_server_errors_rate
+# TYPE http_server_errors_rate gauge
+http_server_errors_rate 6
+# HELP http_requests_delta http_requests_delta
+# TYPE http_requests_delta gauge
+http_requests_delta{code="200",method="GET"} 100
+`
+	assert.Equal(t, expectedSidecarMetricString, convertMetricFamiliesIntoTextString(newSidecarMetrics))
+	// selection does not change the snapshot
+	assert.Equal(t, 1, len(newSnapshot.metrics))
+}
+
+func TestSelectMetricFamilies(t *testing.T) {
+	metricFamilies, err := parsePrometheusMetricsToMetricFamilies(`
+# HELP http_requests_total Counts requests by code
+# TYPE http_requests_total counter
+http_requests_total{code="200"} 100
+http_requests_total{code="500"} 10
+http_requests_total{code="503"} 20
+# HELP request_duration_seconds Request duration
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{code="200",le="0.5"} 80
+request_duration_seconds_bucket{code="200",le="+Inf"} 100
+request_duration_seconds_bucket{code="500",le="0.5"} 1
+request_duration_seconds_bucket{code="500",le="+Inf"} 10
+request_duration_seconds_sum{code="200"} 30
+request_duration_seconds_sum{code="500"} 20
+request_duration_seconds_count{code="200"} 100
+request_duration_seconds_count{code="500"} 10
+`)
+	assert.NoError(t, err)
+	metricFamilies = replaceHistogramSummaryToGauge(metricFamilies)
+
+	// selected metric families keep their name
+	selected := selectMetricFamilies(metricFamilies, `http_requests_total{code=~"5.."}`)
+	assert.Equal(t, 1, len(selected))
+	assert.Equal(t, "http_requests_total", *selected[0].Name)
+	assert.Equal(t, 2, len(selected[0].Metric))
+	// the snapshot is not filtered
+	assert.Equal(t, 3, len(metricFamilies[0].Metric))
+
+	selected = selectMetricFamilies(metricFamilies, "http_requests_total")
+	assert.Equal(t, []*dto.MetricFamily{metricFamilies[0]}, selected)
+
+	selected = selectMetricFamiliesWithSuffix(metricFamilies, `request_duration_seconds{code="500"}`, "_bucket")
+	assert.Equal(t, 1, len(selected))
+	assert.Equal(t, "request_duration_seconds_bucket", *selected[0].Name)
+	assert.Equal(t, 2, len(selected[0].Metric))
+
+	assert.Equal(t, 0, len(selectMetricFamilies(metricFamilies, `http_requests_total{code=~"5.."`)))
+}
+
+func TestCalculateRatioWithDenominatorSelector(t *testing.T) {
+	metricFamilies, err := parsePrometheusMetricsToMetricFamilies(`
+# HELP errors_total Counts errors by method
+# TYPE errors_total counter
+errors_total{method="GET"} 5
+errors_total{method="POST"} 2
+# HELP requests_total Counts requests by method
+# TYPE requests_total counter
+requests_total{method="GET"} 50
+requests_total{method="POST"} 20
+`)
+	assert.NoError(t, err)
+	ratioRule := SidecarRule{Name: "get_error_ratio", Parameters: map[string]string{"numerator": "errors_total", "denominator": `requests_total{method="GET"}`}}
+
+	// the POST denominator does not match the selector
+	ratioMetricString := convertMetricFamiliesIntoTextString(calculateRatio(newTestSnapshot(metricFamilies, 0), ratioRule))
+	assert.Equal(t, `# HELP get_error_ratio get_error_ratio
+# TYPE get_error_ratio gauge
+get_error_ratio{method="GET"} 0.1
+`, ratioMetricString)
+}
+
+func TestGetMetricSelector(t *testing.T) {
+	defer clearMetricSelectors()
+	selector, err := getMetricSelector(`request_count{code=~"5.."}`)
+	assert.NoError(t, err)
+	// parsed once and reused
+	cachedSelector, err := getMetricSelector(`request_count{code=~"5.."}`)
+	assert.NoError(t, err)
+	assert.Equal(t, selector, cachedSelector)
+	assert.Contains(t, parsedMetricSelectors, `request_count{code=~"5.."}`)
+
+	clearMetricSelectors()
+	assert.Empty(t, parsedMetricSelectors)
+}
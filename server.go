@@ -0,0 +1,130 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"context"
+	prometheusClient "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.hpe.com/kronos/kelog"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	serverReadTimeout     = 10 * time.Second
+	serverWriteTimeout    = 30 * time.Second
+	serverShutdownTimeout = 5 * time.Second
+)
+
+// exposition holds the latest metric families served to scrapers and their text format, which most scrapers
+// ask for. The main loop publishes new metrics every cycle while HTTP handlers read them concurrently, so the
+// metrics are swapped atomically and never modified.
+type exposition struct {
+	metrics atomic.Value
+}
+
+type exposedMetrics struct {
+	metricFamilies []*prometheusClient.MetricFamily
+	text           string
+}
+
+func newExposition(metricFamilies []*prometheusClient.MetricFamily) *exposition {
+	e := &exposition{}
+	e.publish(metricFamilies)
+	return e
+}
+
+func (e *exposition) publish(metricFamilies []*prometheusClient.MetricFamily) {
+	e.metrics.Store(exposedMetrics{metricFamilies: metricFamilies, text: convertMetricFamiliesIntoTextString(metricFamilies)})
+}
+
+func (e *exposition) get() exposedMetrics {
+	return e.metrics.Load().(exposedMetrics)
+}
+
+// newMetricsHandler serves the exposition returned by getExposition in the format negotiated with the Accept
+// header: the prometheus text format, the delimited protobuf format or OpenMetrics.
+func newMetricsHandler(getExposition func() exposedMetrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metrics := getExposition()
+		format := negotiateFormat(r.Header)
+		w.Header().Set("Content-Type", string(format))
+		w.Header().Set("Vary", "Accept")
+		var err error
+		switch format {
+		case expfmt.FmtText:
+			_, err = io.WriteString(w, metrics.text)
+		case fmtOpenMetrics:
+			err = writeOpenMetrics(w, mergeMetricFamilies(metrics.metricFamilies))
+		default:
+			encoder := expfmt.NewEncoder(w, format)
+			for _, mf := range mergeMetricFamilies(metrics.metricFamilies) {
+				if err = encoder.Encode(mf); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			log.Debugf("Error writing sidecar metrics: %v", err)
+		}
+	}
+}
+
+// metricsServer keeps the listener of the server, so that the port is released on shutdown even if
+// the server has not started serving yet.
+type metricsServer struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+// startMetricsServer serves the handler on listenPath and listenPort until the returned server is shut down.
+// It fails when the port can not be listened on.
+func startMetricsServer(listenPort string, listenPath string, handler http.HandlerFunc) (*metricsServer, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(listenPath, handler)
+	server := &http.Server{
+		Addr:         ":" + listenPort,
+		Handler:      mux,
+		ReadTimeout:  serverReadTimeout,
+		WriteTimeout: serverWriteTimeout,
+	}
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Error serving sidecar metrics on %v: %v", listenPort+listenPath, err)
+		}
+	}()
+	return &metricsServer{server: server, listener: listener}, nil
+}
+
+// shutdown stops accepting connections and waits for running requests to finish.
+func (s *metricsServer) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		log.Warnf("Error shutting down sidecar metrics server: %v", err)
+	}
+	// already closed when the server was serving
+	s.listener.Close()
+}
+
+// restartMetricsServer moves the server to the listen settings of the new config. If the new port can not be
+// listened on, the server keeps the current listen settings, which are returned in the config.
+func restartMetricsServer(server *metricsServer, currentConfig sidecarConfig, newConfig sidecarConfig, handler http.HandlerFunc) (*metricsServer, sidecarConfig, error) {
+	server.shutdown()
+	newServer, err := startMetricsServer(newConfig.listenPort, newConfig.listenPath, handler)
+	if err == nil {
+		return newServer, newConfig, nil
+	}
+	log.Errorf("Error listening on port %v, keep listening on port %v: %v", newConfig.listenPort, currentConfig.listenPort, err)
+	newConfig.listenPort, newConfig.listenPath = currentConfig.listenPort, currentConfig.listenPath
+	newServer, err = startMetricsServer(currentConfig.listenPort, currentConfig.listenPath, handler)
+	return newServer, newConfig, err
+}
@@ -0,0 +1,160 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	prometheusClient "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+func TestMetricsHandlerWritesExpositionVerbatim(t *testing.T) {
+	exposition := `request_count{path="/100%25",format="%v %s"} 25` + "\n"
+	recorder := httptest.NewRecorder()
+	newMetricsHandler(func() exposedMetrics { return exposedMetrics{text: exposition} })(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, exposition, recorder.Body.String())
+}
+
+func TestMetricsHandlerNegotiatesFormat(t *testing.T) {
+	labels := []*prometheusClient.LabelPair{{Name: proto.String("method"), Value: proto.String("GET")}}
+	sidecarExposition := newExposition([]*prometheusClient.MetricFamily{
+		createNewMetricFamilies("request_count_rate", labels, 2.5),
+		createNewMetricFamilies("request_count_rate", nil, 4),
+	})
+	handler := newMetricsHandler(sidecarExposition.get)
+
+	// prometheus prefers the delimited protobuf format
+	request := httptest.NewRequest("GET", "/metrics", nil)
+	request.Header.Set("Accept", "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3,*/*;q=0.1")
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	assert.Equal(t, string(expfmt.FmtProtoDelim), recorder.Header().Get("Content-Type"))
+	decoder := expfmt.NewDecoder(bytes.NewReader(recorder.Body.Bytes()), expfmt.FmtProtoDelim)
+	mf := &prometheusClient.MetricFamily{}
+	assert.NoError(t, decoder.Decode(mf))
+	// series of the same metric are merged into one family
+	assert.Equal(t, "request_count_rate", mf.GetName())
+	assert.Equal(t, 2, len(mf.Metric))
+
+	request.Header.Set("Accept", "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5")
+	recorder = httptest.NewRecorder()
+	handler(recorder, request)
+	assert.Equal(t, string(fmtOpenMetrics), recorder.Header().Get("Content-Type"))
+	assert.Equal(t, "# TYPE request_count_rate gauge\n# HELP request_count_rate request_count_rate\n"+
+		"request_count_rate{method=\"GET\"} 2.5\nrequest_count_rate 4\n# EOF\n", recorder.Body.String())
+
+	// text without a supported Accept header
+	request.Header.Set("Accept", "application/json")
+	recorder = httptest.NewRecorder()
+	handler(recorder, request)
+	assert.Equal(t, string(expfmt.FmtText), recorder.Header().Get("Content-Type"))
+	assert.Equal(t, sidecarExposition.get().text, recorder.Body.String())
+}
+
+func getFreePort(t *testing.T) string {
+	listener, err := net.Listen("tcp", ":0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func TestStartMetricsServer(t *testing.T) {
+	listenPort := getFreePort(t)
+	server, err := startMetricsServer(listenPort, "/sidecar/metrics", newMetricsHandler(func() exposedMetrics { return exposedMetrics{text: "request_count 25\n"} }))
+	assert.NoError(t, err)
+
+	resp, err := http.Get("http://localhost:" + listenPort + "/sidecar/metrics")
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "request_count 25\n", string(body))
+
+	// the port is in use until the server is shut down
+	_, err = startMetricsServer(listenPort, "/metrics", newMetricsHandler(func() exposedMetrics { return exposedMetrics{} }))
+	assert.Error(t, err)
+	server.shutdown()
+	_, err = http.Get("http://localhost:" + listenPort + "/sidecar/metrics")
+	assert.Error(t, err)
+}
+
+func TestRestartMetricsServerKeepsPortInUse(t *testing.T) {
+	listenPort := getFreePort(t)
+	usedPort := getFreePort(t)
+	listener, err := net.Listen("tcp", ":"+usedPort)
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	handler := newMetricsHandler(func() exposedMetrics { return exposedMetrics{} })
+	currentConfig := sidecarConfig{listenPort: listenPort, listenPath: "/metrics"}
+	server, err := startMetricsServer(currentConfig.listenPort, currentConfig.listenPath, handler)
+	assert.NoError(t, err)
+
+	server, newConfig, err := restartMetricsServer(server, currentConfig, sidecarConfig{listenPort: usedPort, listenPath: "/sidecar/metrics"}, handler)
+	assert.NoError(t, err)
+	assert.Equal(t, listenPort, newConfig.listenPort)
+	assert.Equal(t, "/metrics", newConfig.listenPath)
+	server.shutdown()
+}
+
+func TestExpositionWithConcurrentScrapes(t *testing.T) {
+	sidecarExposition := newExposition([]*prometheusClient.MetricFamily{createNewMetricFamilies("request_count", nil, 0)})
+	server := httptest.NewServer(newMetricsHandler(sidecarExposition.get))
+	defer server.Close()
+
+	// scrape continuously while the loop publishes new expositions
+	done := make(chan struct{})
+	scrapeErrors := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			for {
+				select {
+				case <-done:
+					scrapeErrors <- nil
+					return
+				default:
+				}
+				resp, err := http.Get(server.URL)
+				if err != nil {
+					scrapeErrors <- err
+					return
+				}
+				body, err := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					scrapeErrors <- err
+					return
+				}
+				// every scrape gets one whole exposition
+				if !regexp.MustCompile(`(?s)^# HELP request_count .*\nrequest_count (\d+)\n(# HELP request_total_time .*\nrequest_total_time (\d+)\n)?$`).Match(body) {
+					scrapeErrors <- fmt.Errorf("torn exposition %q", body)
+					return
+				}
+			}
+		}()
+	}
+	for i := 1; i <= 2000; i++ {
+		sidecarExposition.publish([]*prometheusClient.MetricFamily{
+			createNewMetricFamilies("request_count", nil, float64(i)),
+			createNewMetricFamilies("request_total_time", nil, float64(i)),
+		})
+	}
+	close(done)
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, <-scrapeErrors)
+	}
+	assert.Contains(t, sidecarExposition.get().text, "request_count 2000\n")
+	assert.Contains(t, sidecarExposition.get().text, "request_total_time 2000\n")
+}
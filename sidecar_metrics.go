@@ -0,0 +1,62 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	prometheusClient "github.com/prometheus/client_model/go"
+	log "github.hpe.com/kronos/kelog"
+)
+
+// metrics about the sidecar itself, exposed together with the calculated metrics
+var (
+	sidecarRegistry = prometheus.NewRegistry()
+	scrapeUp        = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "sidecar_scrape_up",
+			Help: "Whether the last scrape of the prometheus endpoint succeeded.",
+		},
+	)
+	scrapeFailuresTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "sidecar_scrape_failures_total",
+			Help: "Total number of failed scrapes of the prometheus endpoint.",
+		},
+	)
+	pushFailuresTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sidecar_push_failures_total",
+			Help: "Total number of failed pushes of the calculated metrics, by sink.",
+		},
+		[]string{"sink"},
+	)
+)
+
+func init() {
+	sidecarRegistry.MustRegister(scrapeUp)
+	sidecarRegistry.MustRegister(scrapeFailuresTotal)
+	sidecarRegistry.MustRegister(pushFailuresTotal)
+}
+
+func recordScrapeResult(errScrape error) {
+	if errScrape != nil {
+		scrapeUp.Set(0)
+		scrapeFailuresTotal.Inc()
+		return
+	}
+	scrapeUp.Set(1)
+}
+
+func recordPushResult(sink string, errPush error) {
+	if errPush != nil {
+		pushFailuresTotal.WithLabelValues(sink).Inc()
+	}
+}
+
+func gatherSidecarMetrics() []*prometheusClient.MetricFamily {
+	sidecarMetrics, err := sidecarRegistry.Gather()
+	if err != nil {
+		log.Errorf("Error gathering sidecar metrics: %v", err)
+	}
+	return sidecarMetrics
+}
@@ -0,0 +1,135 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	prometheusClient "github.com/prometheus/client_model/go"
+	"math"
+	"time"
+)
+
+// prometheusSnapshot is one scrape of prometheus metrics with histograms and summaries already converted to gauges.
+// The index of its metrics is built once and shared by every rule looking series up in the snapshot.
+type prometheusSnapshot struct {
+	metrics   []*prometheusClient.MetricFamily
+	timestamp time.Time
+	index     *metricIndex
+}
+
+func newPrometheusSnapshot(prometheusMetrics []*prometheusClient.MetricFamily, timestamp time.Time) prometheusSnapshot {
+	return prometheusSnapshot{metrics: prometheusMetrics, timestamp: timestamp, index: newMetricIndex(prometheusMetrics)}
+}
+
+// withMetrics returns the snapshot with more metric families, only indexing the added ones.
+func (s prometheusSnapshot) withMetrics(prometheusMetrics []*prometheusClient.MetricFamily) prometheusSnapshot {
+	// full slice expression so that appending never writes into the snapshot
+	return prometheusSnapshot{
+		metrics:   append(s.metrics[:len(s.metrics):len(s.metrics)], prometheusMetrics...),
+		timestamp: s.timestamp,
+		index:     s.index.extend(prometheusMetrics),
+	}
+}
+
+// getQueryInterval returns the seconds elapsed between the old and the new snapshot. It is the real time
+// between scrapes, which includes scrape latency, retries and calculation time.
+func getQueryInterval(newSnapshot prometheusSnapshot, oldSnapshot prometheusSnapshot) float64 {
+	return newSnapshot.timestamp.Sub(oldSnapshot.timestamp).Seconds()
+}
+
+// snapshotBuffer is a ring buffer keeping the most recent snapshots. When it is full, adding a
+// snapshot drops the oldest one.
+type snapshotBuffer struct {
+	snapshots []prometheusSnapshot
+	start     int
+	size      int
+}
+
+func newSnapshotBuffer(capacity int) *snapshotBuffer {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &snapshotBuffer{snapshots: make([]prometheusSnapshot, capacity)}
+}
+
+func (b *snapshotBuffer) add(snapshot prometheusSnapshot) {
+	if b.size < len(b.snapshots) {
+		b.snapshots[(b.start+b.size)%len(b.snapshots)] = snapshot
+		b.size++
+		return
+	}
+	b.snapshots[b.start] = snapshot
+	b.start = (b.start + 1) % len(b.snapshots)
+}
+
+func (b *snapshotBuffer) len() int {
+	return b.size
+}
+
+// get returns the i-th snapshot, 0 being the oldest.
+func (b *snapshotBuffer) get(i int) prometheusSnapshot {
+	return b.snapshots[(b.start+i)%len(b.snapshots)]
+}
+
+// findOldSnapshot returns the oldest snapshot taken within window before now. If window is zero or no
+// snapshot is within window, the latest snapshot is returned.
+func (b *snapshotBuffer) findOldSnapshot(now time.Time, window time.Duration) (prometheusSnapshot, bool) {
+	if b.size == 0 {
+		return prometheusSnapshot{}, false
+	}
+	if window > 0 {
+		windowStart := now.Add(-window)
+		for i := 0; i < b.size; i++ {
+			snapshot := b.get(i)
+			if !snapshot.timestamp.Before(windowStart) {
+				return snapshot, true
+			}
+		}
+	}
+	return b.get(b.size - 1), true
+}
+
+// findSnapshotsInWindow returns every snapshot taken within window before now, oldest first.
+func (b *snapshotBuffer) findSnapshotsInWindow(now time.Time, window time.Duration) []prometheusSnapshot {
+	snapshots := []prometheusSnapshot{}
+	windowStart := now.Add(-window)
+	for i := 0; i < b.size; i++ {
+		snapshot := b.get(i)
+		if !snapshot.timestamp.Before(windowStart) {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	return snapshots
+}
+
+func getRuleWindow(rule SidecarRule) time.Duration {
+	window, err := time.ParseDuration(rule.Parameters["window"])
+	if err != nil {
+		return 0
+	}
+	return window
+}
+
+func getSnapshotBufferCapacity(sidecarRules []SidecarRule, queryInterval float64) int {
+	// keep enough snapshots to cover the longest window
+	maxWindow := time.Duration(0)
+	for _, rule := range sidecarRules {
+		if window := getRuleWindow(rule); window > maxWindow {
+			maxWindow = window
+		}
+	}
+	return int(math.Ceil(maxWindow.Seconds()/queryInterval)) + 1
+}
+
+// resize returns a buffer with the new capacity keeping the latest snapshots, so that a reload does not
+// restart rates from scratch.
+func (b *snapshotBuffer) resize(capacity int) *snapshotBuffer {
+	resized := newSnapshotBuffer(capacity)
+	start := b.size - len(resized.snapshots)
+	if start < 0 {
+		start = 0
+	}
+	for i := start; i < b.size; i++ {
+		resized.add(b.get(i))
+	}
+	return resized
+}
@@ -0,0 +1,190 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	prometheusClient "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// newTestSnapshot returns a snapshot of the metrics taken the given seconds after a fixed time.
+func newTestSnapshot(prometheusMetrics []*prometheusClient.MetricFamily, seconds float64) prometheusSnapshot {
+	return newPrometheusSnapshot(prometheusMetrics, time.Unix(1520000000, 0).Add(time.Duration(seconds*float64(time.Second))))
+}
+
+func TestSnapshotBuffer(t *testing.T) {
+	snapshots := newSnapshotBuffer(3)
+	_, ok := snapshots.findOldSnapshot(time.Unix(1520000000, 0), 0)
+	assert.False(t, ok)
+
+	for i := int64(0); i < 5; i++ {
+		snapshots.add(prometheusSnapshot{timestamp: time.Unix(1520000000+30*i, 0)})
+	}
+	// only the latest 3 snapshots are kept, oldest first
+	assert.Equal(t, 3, snapshots.len())
+	assert.Equal(t, time.Unix(1520000060, 0), snapshots.get(0).timestamp)
+	assert.Equal(t, time.Unix(1520000090, 0), snapshots.get(1).timestamp)
+	assert.Equal(t, time.Unix(1520000120, 0), snapshots.get(2).timestamp)
+}
+
+func TestFindOldSnapshot(t *testing.T) {
+	snapshots := newSnapshotBuffer(11)
+	for i := int64(0); i < 11; i++ {
+		snapshots.add(prometheusSnapshot{timestamp: time.Unix(1520000000+30*i, 0)})
+	}
+	now := time.Unix(1520000330, 0)
+
+	// no window, use the previous snapshot
+	oldSnapshot, ok := snapshots.findOldSnapshot(now, 0)
+	assert.True(t, ok)
+	assert.Equal(t, time.Unix(1520000300, 0), oldSnapshot.timestamp)
+
+	// oldest snapshot within 5 minutes
+	oldSnapshot, ok = snapshots.findOldSnapshot(now, 5*time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, time.Unix(1520000030, 0), oldSnapshot.timestamp)
+
+	// window shorter than the query interval, use the previous snapshot
+	oldSnapshot, ok = snapshots.findOldSnapshot(now, 10*time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, time.Unix(1520000300, 0), oldSnapshot.timestamp)
+}
+
+func TestGetSnapshotBufferCapacity(t *testing.T) {
+	sidecarRules, errUnmarshal := unmarshalSidecarRules(`
+- metricName: request_count_rate
+  function: rate
+  parameters:
+    name: request_count
+- metricName: request_count_rate_5m
+  function: rate
+  parameters:
+    name: request_count
+    window: 5m`)
+	assert.NoError(t, errUnmarshal)
+	assert.Equal(t, 11, getSnapshotBufferCapacity(sidecarRules, 30.0))
+	assert.Equal(t, 1, getSnapshotBufferCapacity(sidecarRules[:1], 30.0))
+}
+
+func TestCalculateSidecarRulesWithWindow(t *testing.T) {
+	sidecarRules, errUnmarshal := unmarshalSidecarRules(`
+- metricName: request_count_rate
+  function: rate
+  parameters:
+    name: request_count
+- metricName: request_count_rate_1m
+  function: rate
+  parameters:
+    name: request_count
+    window: 1m`)
+	assert.NoError(t, errUnmarshal)
+	oldSnapshots := newSnapshotBuffer(getSnapshotBufferCapacity(sidecarRules, 30.0))
+	for i, value := range []string{"10", "40"} {
+		metricFamilies, err := parsePrometheusMetricsToMetricFamilies(`
+# TYPE request_count counter
+request_count{method="GET"} ` + value + "\n")
+		assert.NoError(t, err)
+		oldSnapshots.add(newPrometheusSnapshot(metricFamilies, time.Unix(1520000000+30*int64(i), 0)))
+	}
+	newMetricFamilies, err := parsePrometheusMetricsToMetricFamilies(`
+# TYPE request_count counter
+request_count{method="GET"} 100
+`)
+	assert.NoError(t, err)
+
+	// (100 - 40) / 30 = 2
+	// (100 - 10) / 60 = 1.5
+	newSidecarMetrics := calculateSidecarRules(sidecarRules, newPrometheusSnapshot(newMetricFamilies, time.Unix(1520000060, 0)), oldSnapshots)
+	expectedSidecarMetricString := `# HELP request_count_rate request_count_rate
+# TYPE request_count_rate gauge
+request_count_rate{method="GET"} 2
+# HELP request_count_rate_1m request_count_rate_1m
+# TYPE request_count_rate_1m gauge
+request_count_rate_1m{method="GET"} 1.5
+`
+	assert.Equal(t, expectedSidecarMetricString, convertMetricFamiliesIntoTextString(newSidecarMetrics))
+}
+
+func TestCalculateSidecarRulesWithCounterResetInWindow(t *testing.T) {
+	sidecarRules, errUnmarshal := unmarshalSidecarRules(`
+- metricName: request_count_rate_2m
+  function: rate
+  parameters:
+    name: request_count
+    window: 2m
+    compensateCounterReset: "true"
+- metricName: request_count_delta_2m
+  function: delta
+  parameters:
+    name: request_count
+    window: 2m
+    compensateCounterReset: "true"
+- metricName: request_count_uncompensated_rate_2m
+  function: rate
+  parameters:
+    name: request_count
+    window: 2m
+- metricName: request_error_ratio_2m
+  function: deltaRatio
+  parameters:
+    numerator: request_errors
+    denominator: request_count
+    window: 2m
+    compensateCounterReset: "true"`)
+	assert.NoError(t, errUnmarshal)
+	oldSnapshots := newSnapshotBuffer(getSnapshotBufferCapacity(sidecarRules, 30.0))
+	// the counters are reset between 60s and 90s
+	counts := []string{"10", "40", "70", "20"}
+	errors := []string{"1", "2", "4", "1"}
+	for i := range counts {
+		metricFamilies, err := parsePrometheusMetricsToMetricFamilies(`
+# TYPE request_count counter
+request_count{method="GET"} ` + counts[i] + `
+# TYPE request_errors counter
+request_errors{method="GET"} ` + errors[i] + "\n")
+		assert.NoError(t, err)
+		oldSnapshots.add(newPrometheusSnapshot(metricFamilies, time.Unix(1520000000+30*int64(i), 0)))
+	}
+	newMetricFamilies, err := parsePrometheusMetricsToMetricFamilies(`
+# TYPE request_count counter
+request_count{method="GET"} 50
+# TYPE request_errors counter
+request_errors{method="GET"} 3
+`)
+	assert.NoError(t, err)
+
+	// increase = 30 + 30 + 20 + 30 = 110 over 120 seconds, not 50 - 10 = 40
+	// error increase = 1 + 2 + 1 + 2 = 6
+	newSidecarMetrics := calculateSidecarRules(sidecarRules, newPrometheusSnapshot(newMetricFamilies, time.Unix(1520000120, 0)), oldSnapshots)
+	expectedSidecarMetricString := `# HELP request_count_rate_2m request_count_rate_2m
+# TYPE request_count_rate_2m gauge
+request_count_rate_2m{method="GET"} 0.9166666666666666
+# HELP request_count_delta_2m request_count_delta_2m
+# TYPE request_count_delta_2m gauge
+request_count_delta_2m{method="GET"} 110
+# HELP request_error_ratio_2m request_error_ratio_2m
+# TYPE request_error_ratio_2m gauge
+request_error_ratio_2m{method="GET"} 0.05454545454545454
+`
+	assert.Equal(t, expectedSidecarMetricString, convertMetricFamiliesIntoTextString(newSidecarMetrics))
+}
+
+func TestSnapshotBufferResize(t *testing.T) {
+	buffer := newSnapshotBuffer(3)
+	for i := int64(0); i < 3; i++ {
+		buffer.add(prometheusSnapshot{timestamp: time.Unix(1520000000+i, 0)})
+	}
+
+	smaller := buffer.resize(2)
+	assert.Equal(t, 2, smaller.len())
+	assert.Equal(t, time.Unix(1520000001, 0), smaller.get(0).timestamp)
+	assert.Equal(t, time.Unix(1520000002, 0), smaller.get(1).timestamp)
+
+	larger := buffer.resize(5)
+	assert.Equal(t, 3, larger.len())
+	larger.add(prometheusSnapshot{timestamp: time.Unix(1520000003, 0)})
+	assert.Equal(t, 4, larger.len())
+	assert.Equal(t, time.Unix(1520000000, 0), larger.get(0).timestamp)
+}
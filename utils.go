@@ -9,6 +9,7 @@ import (
 	"github.com/prometheus/common/expfmt"
 	log "github.hpe.com/kronos/kelog"
 	"gopkg.in/yaml.v2"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -17,102 +18,28 @@ type SidecarRule struct {
 	Name       string            `yaml:"metricName"`
 	Function   string            `yaml:"function"`
 	Parameters map[string]string `yaml:"parameters"`
+	Aggregate  string            `yaml:"aggregate"`
+	By         []string          `yaml:"by"`
+	Without    []string          `yaml:"without"`
+	On         []string          `yaml:"on"`
+	Ignoring   []string          `yaml:"ignoring"`
+	GroupLeft  []string          `yaml:"group_left"`
+	GroupRight []string          `yaml:"group_right"`
 }
 
-func getSidecarRulesFromAnnotations(annotations map[string]string) (string, float64, string, string) {
-	//get sidecar specific input parameters
-	queryIntervalString := annotations["sidecar/query-interval"]
-	if queryIntervalString == "" {
-		log.Fatalf("sidecar/query-interval can not be empty")
-	}
-
-	listenPort := annotations["prometheus.io/port"]
-	if queryIntervalString == "" {
-		log.Fatalf("prometheus.io/port can not be empty")
-	}
-	listenPath := annotations["prometheus.io/path"]
-	if listenPath == "" {
-		listenPath = "/metrics"
-		log.Infof("\"prometheus.io/path\" is empty, set to default \"/metrics\".")
-	}
-	if !strings.HasPrefix(listenPath, "/") {
-		listenPath = "/" + listenPath
-	}
-
-	queryInterval, errParseFloat := strconv.ParseFloat(queryIntervalString, 64)
-	if queryInterval <= 0.0 || errParseFloat != nil {
-		log.Warnf("Error converting \"sidecar/query-interval\": %v. Set queryInterval to default 30.0 seconds.", errParseFloat)
-		queryInterval = 30.0
-	}
-
-	rules := annotations["sidecar/rules"]
-	if rules == "" {
-		log.Fatalf("sidecar/rules can not be empty")
-	}
-	log.Infof("rules = %s\n", rules)
-	return rules, queryInterval, listenPort, listenPath
-}
-
-func parseYamlSidecarRules(rules string) []SidecarRule {
+func unmarshalSidecarRules(rules string) ([]SidecarRule, error) {
 	var ruleStruct []SidecarRule
 	source := []byte(rules)
 	err := yaml.Unmarshal(source, &ruleStruct)
-	if err != nil {
-		log.Fatalf("Error parsing sidecar rules: ", err)
-	}
-	return ruleStruct
-}
-
-func findDenominatorValue(prometheusMetrics []*prometheusClient.MetricFamily, numeratorLabels []*prometheusClient.LabelPair, denominatorName string) (float64, bool) {
-	for _, pm := range prometheusMetrics {
-		if *pm.Name == denominatorName {
-			for _, metric := range pm.Metric {
-				if checkEqualLabelsWithoutGe(numeratorLabels, metric.Label) {
-					denominatorValueFloat, succeedGetDenominator := getValueBasedOnType(*pm.Type, *metric)
-					return denominatorValueFloat, succeedGetDenominator
-				}
-			}
-		}
-	}
-	return 0.0, false
+	return ruleStruct, err
 }
 
+// checkEqualLabels compares label sets regardless of label order.
 func checkEqualLabels(a, b []*prometheusClient.LabelPair) bool {
-	if a == nil && b == nil {
-		return true
-	}
-
-	if a == nil || b == nil {
-		return false
-	}
-
 	if len(a) != len(b) {
 		return false
 	}
-	for i, subA := range a {
-		if (*subA.Name) != *b[i].Name || *subA.Value != *b[i].Value {
-			return false
-		}
-	}
-	return true
-}
-
-func checkEqualLabelsWithoutGe(a, b []*prometheusClient.LabelPair) bool {
-	// ignore ge and le
-	if a == nil && b == nil {
-		return true
-	}
-	if len(a) > len(b) {
-		// remove "ge" label
-		newA := []*prometheusClient.LabelPair{}
-		for _, subA := range a {
-			if *subA.Name != "ge" {
-				newA = append(newA, subA)
-			}
-		}
-		return checkEqualLabels(newA, b)
-	}
-	return checkEqualLabels(a, b)
+	return convertLabelsIntoKey(a) == convertLabelsIntoKey(b)
 }
 
 func parsePrometheusMetricsToMetricFamilies(text string) ([]*prometheusClient.MetricFamily, error) {
@@ -121,9 +48,15 @@ func parsePrometheusMetricsToMetricFamilies(text string) ([]*prometheusClient.Me
 	if err != nil {
 		return nil, err
 	}
+	// sort by name, the parser returns a map
+	names := []string{}
+	for name := range parsed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 	var result []*prometheusClient.MetricFamily
-	for _, mf := range parsed {
-		result = append(result, mf)
+	for _, name := range names {
+		result = append(result, parsed[name])
 	}
 	return result, nil
 }
@@ -138,41 +71,45 @@ func convertMetricFamiliesIntoTextString(newMetricFamilies []*prometheusClient.M
 }
 
 func convertHistogramToGauge(histogramMetricFamilies *prometheusClient.MetricFamily) []*prometheusClient.MetricFamily {
+	// keep the original labels so that every label set becomes its own _bucket, _sum and _count series
+	labelKeysArray := getMetricFamilyLabelNames(histogramMetricFamilies)
 	reg := prometheus.NewRegistry()
 	histogramBucketMetric := prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: *histogramMetricFamilies.Name + "_bucket",
 			Help: *histogramMetricFamilies.Help,
 		},
-		[]string{
-			"le",
-		},
+		append(append([]string{}, labelKeysArray...), "le"),
 	)
-	histogramSumMetric := prometheus.NewGauge(
+	histogramSumMetric := prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: *histogramMetricFamilies.Name + "_sum",
 			Help: *histogramMetricFamilies.Help,
 		},
+		labelKeysArray,
 	)
-	histogramCountMetric := prometheus.NewGauge(
+	histogramCountMetric := prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: *histogramMetricFamilies.Name + "_count",
 			Help: *histogramMetricFamilies.Help,
 		},
+		labelKeysArray,
 	)
 	reg.MustRegister(histogramBucketMetric)
 	reg.MustRegister(histogramSumMetric)
 	reg.MustRegister(histogramCountMetric)
 	for _, histogramMetric := range histogramMetricFamilies.Metric {
+		labelMap := getLabelMapWithLabelNames(labelKeysArray, histogramMetric.Label)
 		histogramSumValue := float64(*histogramMetric.Histogram.SampleSum)
-		histogramSumMetric.Set(histogramSumValue)
+		histogramSumMetric.With(labelMap).Set(histogramSumValue)
 		histogramCountValue := float64(*histogramMetric.Histogram.SampleCount)
-		histogramCountMetric.Set(histogramCountValue)
+		histogramCountMetric.With(labelMap).Set(histogramCountValue)
 		histogramBuckets := histogramMetric.Histogram.Bucket
 		for _, hBucket := range histogramBuckets {
 			histogramValue := float64(*hBucket.CumulativeCount)
-			labelValue := strconv.FormatFloat(*hBucket.UpperBound, 'f', -1, 64)
-			histogramBucketMetric.WithLabelValues(labelValue).Set(histogramValue)
+			bucketLabelMap := getLabelMapWithLabelNames(labelKeysArray, histogramMetric.Label)
+			bucketLabelMap["le"] = strconv.FormatFloat(*hBucket.UpperBound, 'f', -1, 64)
+			histogramBucketMetric.With(bucketLabelMap).Set(histogramValue)
 		}
 	}
 
@@ -184,19 +121,44 @@ func convertHistogramToGauge(histogramMetricFamilies *prometheusClient.MetricFam
 	return convertedHistogramMetricFamilies
 }
 
-func findOldValueWithMetricFamily(oldPrometheusMetrics []*prometheusClient.MetricFamily, newM *prometheusClient.Metric, newMName string, newMType prometheusClient.MetricType) (float64, bool) {
-	for _, oldMetric := range oldPrometheusMetrics {
-		if newMName != *oldMetric.Name || newMType != *oldMetric.Type {
-			continue
-		}
-		for _, oldM := range oldMetric.Metric {
-			if checkEqualLabels(oldM.Label, newM.Label) {
-				oldMetricValueFloat, succeed := getValueBasedOnType(*oldMetric.Type, *oldM)
-				return oldMetricValueFloat, succeed
+func getMetricFamilyLabelNames(metricFamily *prometheusClient.MetricFamily) []string {
+	// union of label names over all metrics in the family, in order of appearance
+	labelKeysArray := []string{}
+	seen := map[string]bool{}
+	for _, metric := range metricFamily.Metric {
+		for _, label := range metric.Label {
+			if !seen[*label.Name] {
+				seen[*label.Name] = true
+				labelKeysArray = append(labelKeysArray, *label.Name)
 			}
 		}
 	}
-	return 0.0, false
+	return labelKeysArray
+}
+
+func getLabelMapWithLabelNames(labelKeysArray []string, metricLabels []*prometheusClient.LabelPair) map[string]string {
+	// labels missing from this metric are set to empty string
+	labelMap := map[string]string{}
+	for _, labelKey := range labelKeysArray {
+		labelMap[labelKey] = ""
+	}
+	for _, label := range metricLabels {
+		labelMap[*label.Name] = *label.Value
+	}
+	return labelMap
+}
+
+// getIncrease returns newValue - oldValue. If a counter has been reset it fails, unless the rule
+// sets compensateCounterReset, in which case the new value is the increase since the reset.
+func getIncrease(metricType prometheusClient.MetricType, newValue float64, oldValue float64, rule SidecarRule) (float64, bool) {
+	if metricType == prometheusClient.MetricType_COUNTER && newValue < oldValue {
+		compensate, err := strconv.ParseBool(rule.Parameters["compensateCounterReset"])
+		if err != nil || !compensate {
+			return 0.0, false
+		}
+		return newValue, true
+	}
+	return newValue - oldValue, true
 }
 
 func getValueBasedOnType(metricType prometheusClient.MetricType, metric prometheusClient.Metric) (float64, bool) {
@@ -227,6 +189,23 @@ func getLabels(metricLabels []*prometheusClient.LabelPair) ([]string, map[string
 	return labelKeysArray, labelMap
 }
 
+// convertLabelsIntoKey returns a fingerprint of the label set which does not depend on the label order.
+func convertLabelsIntoKey(labels []*prometheusClient.LabelPair) string {
+	if !sort.SliceIsSorted(labels, func(i, j int) bool { return *labels[i].Name < *labels[j].Name }) {
+		sortedLabels := append([]*prometheusClient.LabelPair{}, labels...)
+		sort.Slice(sortedLabels, func(i, j int) bool { return *sortedLabels[i].Name < *sortedLabels[j].Name })
+		labels = sortedLabels
+	}
+	key := strings.Builder{}
+	for _, label := range labels {
+		key.WriteString(*label.Name)
+		key.WriteString("=")
+		key.WriteString(strconv.Quote(*label.Value))
+		key.WriteString(",")
+	}
+	return key.String()
+}
+
 func createNewMetricFamilies(newMetricName string, metricLabels []*prometheusClient.LabelPair, newMetricValue float64) *prometheusClient.MetricFamily {
 	labelKeysArray, labelMap := getLabels(metricLabels)
 	reg := prometheus.NewRegistry()
@@ -267,41 +246,45 @@ func replaceHistogramSummaryToGauge(prometheusMetrics []*prometheusClient.Metric
 }
 
 func convertSummaryToGauge(summaryMetricFamilies *prometheusClient.MetricFamily) []*prometheusClient.MetricFamily {
+	// keep the original labels so that every label set becomes its own quantile, _sum and _count series
+	labelKeysArray := getMetricFamilyLabelNames(summaryMetricFamilies)
 	reg := prometheus.NewRegistry()
 	summaryQuantileMetric := prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: *summaryMetricFamilies.Name,
 			Help: *summaryMetricFamilies.Help,
 		},
-		[]string{
-			"quantile",
-		},
+		append(append([]string{}, labelKeysArray...), "quantile"),
 	)
-	summarySumMetric := prometheus.NewGauge(
+	summarySumMetric := prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: *summaryMetricFamilies.Name + "_sum",
 			Help: *summaryMetricFamilies.Help,
 		},
+		labelKeysArray,
 	)
-	summaryCountMetric := prometheus.NewGauge(
+	summaryCountMetric := prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: *summaryMetricFamilies.Name + "_count",
 			Help: *summaryMetricFamilies.Help,
 		},
+		labelKeysArray,
 	)
 	reg.MustRegister(summaryQuantileMetric)
 	reg.MustRegister(summarySumMetric)
 	reg.MustRegister(summaryCountMetric)
 	for _, summaryMetric := range summaryMetricFamilies.Metric {
+		labelMap := getLabelMapWithLabelNames(labelKeysArray, summaryMetric.Label)
 		summarySumValue := float64(*summaryMetric.Summary.SampleSum)
-		summarySumMetric.Set(summarySumValue)
+		summarySumMetric.With(labelMap).Set(summarySumValue)
 		summaryCountValue := float64(*summaryMetric.Summary.SampleCount)
-		summaryCountMetric.Set(summaryCountValue)
+		summaryCountMetric.With(labelMap).Set(summaryCountValue)
 		summaryQuantiles := summaryMetric.Summary.Quantile
 		for _, hQuantile := range summaryQuantiles {
 			summaryValue := float64(*hQuantile.Value)
-			labelValue := strconv.FormatFloat(*hQuantile.Quantile, 'f', -1, 64)
-			summaryQuantileMetric.WithLabelValues(labelValue).Set(summaryValue)
+			quantileLabelMap := getLabelMapWithLabelNames(labelKeysArray, summaryMetric.Label)
+			quantileLabelMap["quantile"] = strconv.FormatFloat(*hQuantile.Quantile, 'f', -1, 64)
+			summaryQuantileMetric.With(quantileLabelMap).Set(summaryValue)
 		}
 	}
 
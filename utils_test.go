@@ -30,7 +30,8 @@ func TestSplitRules(t *testing.T) {
     numerator: request_total_time
     denominator: request_count`
 
-	ruleStruct := parseYamlSidecarRules(rules)
+	ruleStruct, errUnmarshal := unmarshalSidecarRules(rules)
+	assert.NoError(t, errUnmarshal)
 	var expectedRules []SidecarRule
 	param1 := map[string]string{}
 	param1["numerator"] = "request_total_time"
@@ -71,7 +72,7 @@ request_total_time{method="POST",path="/rest/support"} 1.2
 	assert.NoError(t, err)
 	for _, metricFamily := range metricFamilies {
 		for _, m := range metricFamily.Metric {
-			newDenominatorValueFloat, succeedNewDenominator := findDenominatorValue(metricFamilies, m.Label, "request_total_time")
+			newDenominatorValueFloat, succeedNewDenominator := newMetricIndex(metricFamilies).findDenominatorValue("request_total_time", m.Label)
 			if checkEqualLabels(m.Label, labelPairs1) {
 				assert.True(t, succeedNewDenominator)
 				assert.Equal(t, 0.9, newDenominatorValueFloat)
@@ -100,7 +101,7 @@ request_total_time{method="GET",path="/rest/metrics/1"} 0.9
 	}
 	metricFamilies, err := parsePrometheusMetricsToMetricFamilies(prometheusMetricsString)
 	assert.NoError(t, err)
-	newDenominatorValueFloat, succeedNewDenominator := findDenominatorValue(metricFamilies, labelPairs, "request_total_time")
+	newDenominatorValueFloat, succeedNewDenominator := newMetricIndex(metricFamilies).findDenominatorValue("request_total_time", labelPairs)
 	assert.False(t, succeedNewDenominator)
 	assert.Equal(t, 0.0, newDenominatorValueFloat)
 }
@@ -258,3 +259,81 @@ go_gc_duration_seconds_sum 1.289634876
 `
 	assert.Equal(t, expectedString, replacedMetricFamiliesString)
 }
+
+func TestConvertHistogramToGaugeWithLabels(t *testing.T) {
+	histogramMetricsString := `# HELP http_request_duration_seconds A histogram of the request duration.
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{method="GET",path="/rest/metrics",le="0.1"} 10
+http_request_duration_seconds_bucket{method="GET",path="/rest/metrics",le="+Inf"} 12
+http_request_duration_seconds_sum{method="GET",path="/rest/metrics"} 0.8
+http_request_duration_seconds_count{method="GET",path="/rest/metrics"} 12
+http_request_duration_seconds_bucket{method="POST",path="/rest/support",le="0.1"} 3
+http_request_duration_seconds_bucket{method="POST",path="/rest/support",le="+Inf"} 7
+http_request_duration_seconds_sum{method="POST",path="/rest/support"} 1.5
+http_request_duration_seconds_count{method="POST",path="/rest/support"} 7
+`
+	histogramMetricFamilies, err := parsePrometheusMetricsToMetricFamilies(histogramMetricsString)
+	assert.NoError(t, err)
+	convertedHistogramMetricFamilies := convertHistogramToGauge(histogramMetricFamilies[0])
+	convertHistogramToGaugeString := convertMetricFamiliesIntoTextString(convertedHistogramMetricFamilies)
+	expectedString := `# HELP http_request_duration_seconds_bucket A histogram of the request duration.
+# TYPE http_request_duration_seconds_bucket gauge
+http_request_duration_seconds_bucket{le="+Inf",method="GET",path="/rest/metrics"} 12
+http_request_duration_seconds_bucket{le="+Inf",method="POST",path="/rest/support"} 7
+http_request_duration_seconds_bucket{le="0.1",method="GET",path="/rest/metrics"} 10
+http_request_duration_seconds_bucket{le="0.1",method="POST",path="/rest/support"} 3
+# HELP http_request_duration_seconds_count A histogram of the request duration.
+# TYPE http_request_duration_seconds_count gauge
+http_request_duration_seconds_count{method="GET",path="/rest/metrics"} 12
+http_request_duration_seconds_count{method="POST",path="/rest/support"} 7
+# HELP http_request_duration_seconds_sum A histogram of the request duration.
+# TYPE http_request_duration_seconds_sum gauge
+http_request_duration_seconds_sum{method="GET",path="/rest/metrics"} 0.8
+http_request_duration_seconds_sum{method="POST",path="/rest/support"} 1.5
+`
+	assert.Equal(t, expectedString, convertHistogramToGaugeString)
+}
+
+func TestConvertSummaryToGaugeWithLabels(t *testing.T) {
+	summaryMetricsString := `# HELP request_duration_seconds A summary of the request durations.
+# TYPE request_duration_seconds summary
+request_duration_seconds{method="GET",quantile="0.5"} 0.2
+request_duration_seconds{method="GET",quantile="0.9"} 0.4
+request_duration_seconds_sum{method="GET"} 3.5
+request_duration_seconds_count{method="GET"} 12
+request_duration_seconds{method="POST",quantile="0.5"} 0.6
+request_duration_seconds{method="POST",quantile="0.9"} 1.2
+request_duration_seconds_sum{method="POST"} 4.5
+request_duration_seconds_count{method="POST"} 7
+`
+	summaryMetricFamilies, err := parsePrometheusMetricsToMetricFamilies(summaryMetricsString)
+	assert.NoError(t, err)
+	convertedSummaryMetricFamilies := convertSummaryToGauge(summaryMetricFamilies[0])
+	convertSummaryToGaugeString := convertMetricFamiliesIntoTextString(convertedSummaryMetricFamilies)
+	expectedString := `# HELP request_duration_seconds A summary of the request durations.
+# TYPE request_duration_seconds gauge
+request_duration_seconds{method="GET",quantile="0.5"} 0.2
+request_duration_seconds{method="GET",quantile="0.9"} 0.4
+request_duration_seconds{method="POST",quantile="0.5"} 0.6
+request_duration_seconds{method="POST",quantile="0.9"} 1.2
+# HELP request_duration_seconds_count A summary of the request durations.
+# TYPE request_duration_seconds_count gauge
+request_duration_seconds_count{method="GET"} 12
+request_duration_seconds_count{method="POST"} 7
+# HELP request_duration_seconds_sum A summary of the request durations.
+# TYPE request_duration_seconds_sum gauge
+request_duration_seconds_sum{method="GET"} 3.5
+request_duration_seconds_sum{method="POST"} 4.5
+`
+	assert.Equal(t, expectedString, convertSummaryToGaugeString)
+}
+
+func TestParsePrometheusMetricsSortedByName(t *testing.T) {
+	prometheusMetrics, err := parsePrometheusMetricsToMetricFamilies("c 1\na 2\nb 3\n")
+	assert.NoError(t, err)
+	names := []string{}
+	for _, mf := range prometheusMetrics {
+		names = append(names, *mf.Name)
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, names)
+}
@@ -0,0 +1,199 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"fmt"
+	prometheusClient "github.com/prometheus/client_model/go"
+	log "github.hpe.com/kronos/kelog"
+)
+
+type vectorSample struct {
+	labels []*prometheusClient.LabelPair
+	value  float64
+}
+
+type vectorMatch struct {
+	labels      []*prometheusClient.LabelPair
+	numerator   float64
+	denominator float64
+}
+
+func hasVectorMatching(rule SidecarRule) bool {
+	return len(rule.On) > 0 || len(rule.Ignoring) > 0 || rule.GroupLeft != nil || rule.GroupRight != nil
+}
+
+func validateVectorMatching(rule SidecarRule) error {
+	if len(rule.On) > 0 && len(rule.Ignoring) > 0 {
+		return fmt.Errorf("rule %v can not set both on and ignoring", rule.Name)
+	}
+	if rule.GroupLeft != nil && rule.GroupRight != nil {
+		return fmt.Errorf("rule %v can not set both group_left and group_right", rule.Name)
+	}
+	return nil
+}
+
+// getVectorMatchingSignature returns the labels used to match series: the labels listed in on,
+// or every label except the ones listed in ignoring.
+func getVectorMatchingSignature(labels []*prometheusClient.LabelPair, rule SidecarRule) string {
+	signatureLabels := []*prometheusClient.LabelPair{}
+	for _, label := range labels {
+		if len(rule.On) > 0 && !containsString(rule.On, *label.Name) {
+			continue
+		}
+		if containsString(rule.Ignoring, *label.Name) {
+			continue
+		}
+		signatureLabels = append(signatureLabels, label)
+	}
+	return convertLabelsIntoKey(signatureLabels)
+}
+
+// matchVectors pairs numerator and denominator samples like PromQL binary operators with on, ignoring,
+// group_left and group_right. Without grouping every signature must be unique on both sides.
+func matchVectors(numerators []vectorSample, denominators []vectorSample, rule SidecarRule) []vectorMatch {
+	// the "many" side keeps its labels, the "one" side is looked up by signature
+	manySamples, oneSamples, includeLabels := numerators, denominators, rule.GroupLeft
+	if rule.GroupRight != nil {
+		manySamples, oneSamples, includeLabels = denominators, numerators, rule.GroupRight
+	}
+	grouped := rule.GroupLeft != nil || rule.GroupRight != nil
+
+	oneBySignature := map[string]vectorSample{}
+	duplicatedSignatures := map[string]bool{}
+	for _, oneSample := range oneSamples {
+		signature := getVectorMatchingSignature(oneSample.labels, rule)
+		if _, exists := oneBySignature[signature]; exists {
+			duplicatedSignatures[signature] = true
+		}
+		oneBySignature[signature] = oneSample
+	}
+
+	matches := []vectorMatch{}
+	matchedSignatures := map[string]bool{}
+	for _, manySample := range manySamples {
+		signature := getVectorMatchingSignature(manySample.labels, rule)
+		oneSample, ok := oneBySignature[signature]
+		if !ok {
+			continue
+		}
+		if duplicatedSignatures[signature] {
+			log.Warnf("Rule %v found duplicate series for the match group %v on the one side", rule.Name, signature)
+			continue
+		}
+		if !grouped {
+			if matchedSignatures[signature] {
+				log.Warnf("Rule %v found many-to-one matching for the match group %v, group_left or group_right is needed", rule.Name, signature)
+				continue
+			}
+			matchedSignatures[signature] = true
+		}
+		match := vectorMatch{labels: getVectorMatchingLabels(manySample.labels, oneSample.labels, includeLabels, grouped, rule)}
+		if rule.GroupRight != nil {
+			match.numerator, match.denominator = oneSample.value, manySample.value
+		} else {
+			match.numerator, match.denominator = manySample.value, oneSample.value
+		}
+		matches = append(matches, match)
+	}
+	return matches
+}
+
+// matchVectorsByLabels pairs numerator and denominator samples the way ratio does without vector matching: the
+// denominator has the labels of the numerator, or the labels of the numerator without "ge".
+func matchVectorsByLabels(numerators []vectorSample, denominators []vectorSample) []vectorMatch {
+	denominatorsByLabels := map[string]vectorSample{}
+	for _, denominator := range denominators {
+		denominatorsByLabels[convertLabelsIntoKey(denominator.labels)] = denominator
+	}
+	matches := []vectorMatch{}
+	for _, numerator := range numerators {
+		denominator, ok := denominatorsByLabels[convertLabelsIntoKey(numerator.labels)]
+		if !ok {
+			denominator, ok = denominatorsByLabels[convertLabelsIntoKey(removeLabel(numerator.labels, "ge"))]
+		}
+		if ok {
+			matches = append(matches, vectorMatch{labels: numerator.labels, numerator: numerator.value, denominator: denominator.value})
+		}
+	}
+	return matches
+}
+
+func getVectorMatchingLabels(manyLabels []*prometheusClient.LabelPair, oneLabels []*prometheusClient.LabelPair, includeLabels []string, grouped bool, rule SidecarRule) []*prometheusClient.LabelPair {
+	resultLabels := []*prometheusClient.LabelPair{}
+	if grouped {
+		// keep the labels of the "many" side and copy the included labels from the "one" side
+		for _, label := range manyLabels {
+			if !containsString(includeLabels, *label.Name) {
+				resultLabels = append(resultLabels, label)
+			}
+		}
+		for _, label := range oneLabels {
+			if containsString(includeLabels, *label.Name) {
+				resultLabels = append(resultLabels, label)
+			}
+		}
+		return resultLabels
+	}
+	for _, label := range manyLabels {
+		if len(rule.On) > 0 && !containsString(rule.On, *label.Name) {
+			continue
+		}
+		if containsString(rule.Ignoring, *label.Name) {
+			continue
+		}
+		resultLabels = append(resultLabels, label)
+	}
+	return resultLabels
+}
+
+func getVectorSamples(prometheusMetrics []*prometheusClient.MetricFamily, metricName string) []vectorSample {
+	samples := []vectorSample{}
+	for _, pm := range selectMetricFamilies(prometheusMetrics, metricName) {
+		for _, metric := range pm.Metric {
+			value, succeed := getValueBasedOnType(*pm.Type, *metric)
+			if !succeed {
+				log.Warnf("Error getting values from prometheus metric: %v", *pm.Name)
+				continue
+			}
+			samples = append(samples, vectorSample{labels: metric.Label, value: value})
+		}
+	}
+	return samples
+}
+
+func getDeltaVectorSamples(newSnapshot prometheusSnapshot, oldSnapshot prometheusSnapshot, metricName string, rule SidecarRule) []vectorSample {
+	samples := []vectorSample{}
+	for _, pm := range selectMetricFamilies(newSnapshot.metrics, metricName) {
+		for _, newM := range pm.Metric {
+			oldValueFloat, succeedOld := oldSnapshot.index.findValue(*pm.Name, *pm.Type, newM.Label)
+			if !succeedOld {
+				continue
+			}
+			newValueFloat, succeedNew := getValueBasedOnType(*pm.Type, *newM)
+			if !succeedNew {
+				log.Warnf("Error getting values from new prometheus metric: %v", *pm.Name)
+				continue
+			}
+			delta, succeedIncrease := getIncrease(*pm.Type, newValueFloat, oldValueFloat, rule)
+			if !succeedIncrease {
+				log.Warnf("Counter %v has been reset", *pm.Name)
+				continue
+			}
+			samples = append(samples, vectorSample{labels: newM.Label, value: delta})
+		}
+	}
+	return samples
+}
+
+func calculateRatioWithVectorMatching(numerators []vectorSample, denominators []vectorSample, rule SidecarRule) []*prometheusClient.MetricFamily {
+	newRatioMetrics := []*prometheusClient.MetricFamily{}
+	for _, match := range matchVectors(numerators, denominators, rule) {
+		if match.denominator == 0.0 {
+			log.Infof("Denominator value of rule %v with labels %v cannot be zero", rule.Name, match.labels)
+			continue
+		}
+		newRatioMetrics = append(newRatioMetrics, createNewMetricFamilies(rule.Name, match.labels, match.numerator/match.denominator))
+	}
+	return newRatioMetrics
+}
@@ -0,0 +1,151 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+	"testing"
+)
+
+func TestCalculateRatioWithGroupLeft(t *testing.T) {
+	prometheusMetricsString := `
+# HELP request_errors Counts request errors by path and code
+# TYPE request_errors counter
+request_errors{code="500",path="/rest/metrics"} 3
+request_errors{code="503",path="/rest/metrics"} 6
+request_errors{code="500",path="/rest/support"} 2
+# HELP request_count Counts requests by path
+# TYPE request_count counter
+request_count{instance="a",path="/rest/metrics"} 30
+request_count{instance="a",path="/rest/support"} 20
+`
+	metricFamilies, err := parsePrometheusMetricsToMetricFamilies(prometheusMetricsString)
+	assert.NoError(t, err)
+	ratioRuleParam := map[string]string{}
+	ratioRuleParam["numerator"] = "request_errors"
+	ratioRuleParam["denominator"] = "request_count"
+	ratioRule := SidecarRule{Name: "ratioRuleTestName", Function: "ratio", Parameters: ratioRuleParam, On: []string{"path"}, GroupLeft: []string{"instance"}}
+
+	// 3 / 30 = 0.1
+	// 6 / 30 = 0.2
+	// 2 / 20 = 0.1
+	ratioMetricFamilies := calculateRatio(newTestSnapshot(metricFamilies, 0), ratioRule)
+	ratioMetricString := convertMetricFamiliesIntoTextString(ratioMetricFamilies)
+	expectedRatioMetricString := `# HELP ratioRuleTestName ratioRuleTestName
+# TYPE ratioRuleTestName gauge
+ratioRuleTestName{code="500",instance="a",path="/rest/metrics"} 0.1
+# HELP ratioRuleTestName ratioRuleTestName
+# TYPE ratioRuleTestName gauge
+ratioRuleTestName{code="503",instance="a",path="/rest/metrics"} 0.2
+# HELP ratioRuleTestName ratioRuleTestName
+# TYPE ratioRuleTestName gauge
+ratioRuleTestName{code="500",instance="a",path="/rest/support"} 0.1
+`
+	assert.Equal(t, expectedRatioMetricString, ratioMetricString)
+}
+
+func TestCalculateRatioWithIgnoring(t *testing.T) {
+	prometheusMetricsString := `
+# HELP request_errors Counts request errors by path
+# TYPE request_errors counter
+request_errors{path="/rest/metrics",type="errors"} 3
+# HELP request_count Counts requests by path
+# TYPE request_count counter
+request_count{path="/rest/metrics",type="all"} 30
+`
+	metricFamilies, err := parsePrometheusMetricsToMetricFamilies(prometheusMetricsString)
+	assert.NoError(t, err)
+	ratioRuleParam := map[string]string{}
+	ratioRuleParam["numerator"] = "request_errors"
+	ratioRuleParam["denominator"] = "request_count"
+	ratioRule := SidecarRule{Name: "ratioRuleTestName", Function: "ratio", Parameters: ratioRuleParam, Ignoring: []string{"type"}}
+
+	ratioMetricString := convertMetricFamiliesIntoTextString(calculateRatio(newTestSnapshot(metricFamilies, 0), ratioRule))
+	expectedRatioMetricString := `# HELP ratioRuleTestName ratioRuleTestName
+# TYPE ratioRuleTestName gauge
+ratioRuleTestName{path="/rest/metrics"} 0.1
+`
+	assert.Equal(t, expectedRatioMetricString, ratioMetricString)
+}
+
+func TestCalculateRatioWithManyToOneWithoutGroup(t *testing.T) {
+	prometheusMetricsString := `
+# HELP request_errors Counts request errors by path and code
+# TYPE request_errors counter
+request_errors{code="500",path="/rest/metrics"} 3
+request_errors{code="503",path="/rest/metrics"} 6
+# HELP request_count Counts requests by path
+# TYPE request_count counter
+request_count{path="/rest/metrics"} 30
+`
+	metricFamilies, err := parsePrometheusMetricsToMetricFamilies(prometheusMetricsString)
+	assert.NoError(t, err)
+	ratioRuleParam := map[string]string{}
+	ratioRuleParam["numerator"] = "request_errors"
+	ratioRuleParam["denominator"] = "request_count"
+	ratioRule := SidecarRule{Name: "ratioRuleTestName", Function: "ratio", Parameters: ratioRuleParam, On: []string{"path"}}
+
+	// only the first numerator series is matched one-to-one
+	ratioMetricFamilies := calculateRatio(newTestSnapshot(metricFamilies, 0), ratioRule)
+	assert.Equal(t, 1, len(ratioMetricFamilies))
+}
+
+func TestCalculateDeltaRatioWithGroupRight(t *testing.T) {
+	oldPrometheusMetricsString := `
+# HELP request_total_time Total time in second requests take by path
+# TYPE request_total_time counter
+request_total_time{path="/rest/metrics"} 0.5
+# HELP request_count Counts requests by method and path
+# TYPE request_count counter
+request_count{method="GET",path="/rest/metrics"} 25
+request_count{method="POST",path="/rest/metrics"} 10
+`
+	newPrometheusMetricsString := `
+# HELP request_total_time Total time in second requests take by path
+# TYPE request_total_time counter
+request_total_time{path="/rest/metrics"} 1.5
+# HELP request_count Counts requests by method and path
+# TYPE request_count counter
+request_count{method="GET",path="/rest/metrics"} 30
+request_count{method="POST",path="/rest/metrics"} 20
+`
+	oldMetricFamilies, errOldMF := parsePrometheusMetricsToMetricFamilies(oldPrometheusMetricsString)
+	newMetricFamilies, errNewMF := parsePrometheusMetricsToMetricFamilies(newPrometheusMetricsString)
+	assert.NoError(t, errOldMF)
+	assert.NoError(t, errNewMF)
+	deltaRatioRuleParam := map[string]string{}
+	deltaRatioRuleParam["numerator"] = "request_total_time"
+	deltaRatioRuleParam["denominator"] = "request_count"
+	deltaRatioRule := SidecarRule{Name: "deltaRatioRuleTestName", Function: "deltaRatio", Parameters: deltaRatioRuleParam, On: []string{"path"}, GroupRight: []string{}}
+
+	// (1.5 - 0.5) / (30 - 25) = 0.2
+	// (1.5 - 0.5) / (20 - 10) = 0.1
+	deltaRatioMetricString := convertMetricFamiliesIntoTextString(calculateDeltaRatio(newTestSnapshot(newMetricFamilies, 30), newTestSnapshot(oldMetricFamilies, 0), deltaRatioRule))
+	expectedDeltaRatioMetricString := `# HELP deltaRatioRuleTestName deltaRatioRuleTestName
+# TYPE deltaRatioRuleTestName gauge
+deltaRatioRuleTestName{method="GET",path="/rest/metrics"} 0.2
+# HELP deltaRatioRuleTestName deltaRatioRuleTestName
+# TYPE deltaRatioRuleTestName gauge
+deltaRatioRuleTestName{method="POST",path="/rest/metrics"} 0.1
+`
+	assert.Equal(t, expectedDeltaRatioMetricString, deltaRatioMetricString)
+}
+
+func TestValidateVectorMatching(t *testing.T) {
+	rule := SidecarRule{Name: "ratioRuleTestName", Function: "ratio", On: []string{"path"}, Ignoring: []string{"code"}}
+	assert.Error(t, validateVectorMatching(rule))
+	rule = SidecarRule{Name: "ratioRuleTestName", Function: "ratio", GroupLeft: []string{}, GroupRight: []string{}}
+	assert.Error(t, validateVectorMatching(rule))
+	rule = SidecarRule{Name: "ratioRuleTestName", Function: "ratio", On: []string{"path"}, GroupLeft: []string{}}
+	assert.NoError(t, validateVectorMatching(rule))
+}
+
+func TestParseVectorMatchingWithEmptyGroup(t *testing.T) {
+	rules := []SidecarRule{}
+	err := yaml.Unmarshal([]byte("- metricName: ratioRuleTestName\n  on: [path]\n  group_left: []\n"), &rules)
+	assert.NoError(t, err)
+	assert.True(t, hasVectorMatching(rules[0]))
+	assert.NotNil(t, rules[0].GroupLeft)
+	assert.Nil(t, rules[0].GroupRight)
+}
@@ -0,0 +1,86 @@
+// (C) Copyright 2018 Hewlett Packard Enterprise Development LP
+
+package main
+
+import (
+	prometheusClient "github.com/prometheus/client_model/go"
+	log "github.hpe.com/kronos/kelog"
+)
+
+// windowIncrease is the increase of a series summed over every step between the snapshots of a window.
+type windowIncrease struct {
+	labels         []*prometheusClient.LabelPair
+	increase       float64
+	elapsedSeconds float64
+}
+
+// getWindowIncreases returns the increase over the window of every series selected by the rule parameter in the
+// newest snapshot.
+func getWindowIncreases(snapshots []prometheusSnapshot, parameterValue string, rule SidecarRule) []windowIncrease {
+	increases := []windowIncrease{}
+	if len(snapshots) == 0 {
+		return increases
+	}
+	for _, pm := range selectMetricFamilies(snapshots[len(snapshots)-1].metrics, parameterValue) {
+		name, metricType := *pm.Name, *pm.Type
+		for _, newM := range pm.Metric {
+			labels := newM.Label
+			increase, elapsedSeconds, succeed := getSeriesWindowIncrease(snapshots, name, rule, func(index *metricIndex) (indexedMetric, bool) {
+				metric, ok := index.findMetric(name, metricType, labels)
+				return indexedMetric{metricType: metricType, metric: metric}, ok
+			})
+			if succeed {
+				increases = append(increases, windowIncrease{labels: labels, increase: increase, elapsedSeconds: elapsedSeconds})
+			}
+		}
+	}
+	return increases
+}
+
+// getSeriesWindowIncrease sums the increase of the series found by lookup between every two consecutive snapshots
+// where it is present, so that a counter reset within the window is handled at the step it happens, and returns
+// the seconds elapsed between the first and the last sample. It fails with fewer than two samples or on a counter
+// reset the rule does not compensate.
+func getSeriesWindowIncrease(snapshots []prometheusSnapshot, metricName string, rule SidecarRule, lookup func(index *metricIndex) (indexedMetric, bool)) (float64, float64, bool) {
+	increase := 0.0
+	samples := 0
+	var previousValue float64
+	var first, last overTimeSample
+	for _, snapshot := range snapshots {
+		indexed, ok := lookup(snapshot.index)
+		if !ok {
+			continue
+		}
+		value, succeedValue := getValueBasedOnType(indexed.metricType, *indexed.metric)
+		if !succeedValue {
+			log.Warnf("Error getting values from prometheus metric: %v", metricName)
+			continue
+		}
+		sample := overTimeSample{value: value, timestamp: getSampleTimestamp(indexed.metric, snapshot.timestamp)}
+		if samples == 0 {
+			first = sample
+		} else {
+			stepIncrease, succeedIncrease := getIncrease(indexed.metricType, value, previousValue, rule)
+			if !succeedIncrease {
+				log.Warnf("Counter %v has been reset", metricName)
+				return 0.0, 0.0, false
+			}
+			increase += stepIncrease
+		}
+		previousValue = value
+		last = sample
+		samples++
+	}
+	if samples < 2 {
+		return 0.0, 0.0, false
+	}
+	return increase, last.timestamp.Sub(first.timestamp).Seconds(), true
+}
+
+func getWindowVectorSamples(increases []windowIncrease) []vectorSample {
+	samples := []vectorSample{}
+	for _, windowIncrease := range increases {
+		samples = append(samples, vectorSample{labels: windowIncrease.labels, value: windowIncrease.increase})
+	}
+	return samples
+}